@@ -0,0 +1,485 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Directories are backed up as tar archives with names relative to the directory.
+// Files matching a pattern of .linateignore in the directory are left out.
+const ignoreFileName = ".linateignore"
+
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// ignoreList holds the patterns of a .linateignore file. A pattern without a slash
+// matches the name of a file at any depth, otherwise the path relative to the
+// directory. A pattern ending with a slash only matches directories.
+type ignoreList []string
+
+func readIgnoreFile(root string) (ignoreList, error) {
+	f, e := os.Open(filepath.Join(root, ignoreFileName))
+	if os.IsNotExist(e) {
+		return nil, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	var l ignoreList
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		l = append(l, line)
+	}
+	return l, sc.Err()
+}
+
+func (l ignoreList) matches(rel string, isDir bool) bool {
+	for _, pattern := range l {
+		if strings.HasSuffix(pattern, "/") {
+			if isDir == false {
+				continue
+			}
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+		name := filepath.Base(rel)
+		if strings.Contains(pattern, "/") {
+			pattern = strings.TrimPrefix(pattern, "/")
+			name = rel
+		}
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isLeftOut reports whether a file is left out of a directory backup: it is ignored,
+// a temporary file of linate or a backup of a file in the directory.
+func (l ignoreList) isLeftOut(rel string, d fs.DirEntry) bool {
+	if strings.Contains(d.Name(), ".linate-tmp-") || d.Name() == sidecarName || l.matches(rel, d.IsDir()) {
+		return true
+	}
+	_, ok := parseBackupName(d.Name())
+	return ok && d.IsDir() == false
+}
+
+// walkTree calls fn for root and every file below it that is not left out, with the
+// path relative to root.
+func walkTree(root string, fn func(path string, rel string, d fs.DirEntry) error) error {
+	ignore, e := readIgnoreFile(root)
+	if e != nil {
+		return e
+	}
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+		rel, _ := filepath.Rel(root, path)
+		if rel != "." && ignore.isLeftOut(rel, d) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(path, rel, d)
+	})
+}
+
+var ownerNames = map[string]string{}
+
+// lookupName returns the user or group name of an id, empty when it is unknown.
+func lookupName(id uint32, group bool) string {
+	key := fmt.Sprintf("%v:%d", group, id)
+	if name, ok := ownerNames[key]; ok {
+		return name
+	}
+	name := ""
+	if group {
+		if g, e := user.LookupGroupId(strconv.Itoa(int(id))); e == nil {
+			name = g.Name
+		}
+	} else {
+		if u, e := user.LookupId(strconv.Itoa(int(id))); e == nil {
+			name = u.Username
+		}
+	}
+	ownerNames[key] = name
+	return name
+}
+
+// writeArchive writes the directory root to w as a tar archive. Mode, owner, times
+// and extended attributes are kept in the headers. Sockets and devices are left out
+// and returned.
+func writeArchive(w io.Writer, root string) ([]string, error) {
+	var skipped []string
+	tw := tar.NewWriter(w)
+	e := walkTree(root, func(path string, rel string, d fs.DirEntry) error {
+		info, e := os.Lstat(path)
+		if e != nil {
+			return e
+		}
+		if info.Mode()&(os.ModeSocket|os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe) != 0 {
+			skipped = append(skipped, rel)
+			return nil
+		}
+		hdr, e := fileHeader(path, filepath.ToSlash(rel), info)
+		if e != nil {
+			return e
+		}
+		if e = tw.WriteHeader(hdr); e != nil {
+			return e
+		}
+		if info.Mode().IsRegular() {
+			f, e := os.Open(path)
+			if e != nil {
+				return e
+			}
+			_, e = io.Copy(tw, f)
+			f.Close()
+			return e
+		}
+		return nil
+	})
+	if e != nil {
+		return skipped, e
+	}
+	return skipped, tw.Close()
+}
+
+// fileHeader returns the tar header of the file at path named name in the archive,
+// with its owner, times and extended attributes.
+func fileHeader(path string, name string, info os.FileInfo) (*tar.Header, error) {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var e error
+		if link, e = os.Readlink(path); e != nil {
+			return nil, e
+		}
+	}
+	hdr, e := tar.FileInfoHeader(info, link)
+	if e != nil {
+		return nil, e
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Format = tar.FormatPAX
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		hdr.Uname = lookupName(stat.Uid, false)
+		hdr.Gname = lookupName(stat.Gid, true)
+		hdr.AccessTime = time.Unix(stat.Atim.Unix())
+	}
+	names, _ := listXattrs(path)
+	for _, name := range names {
+		if value, e := getXattr(path, name); e == nil {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords[xattrPAXPrefix+name] = string(value)
+		}
+	}
+	return hdr, nil
+}
+
+// memberPath returns where an archive member is extracted in dest, it refuses names
+// that leave dest.
+func memberPath(dest string, name string) (string, error) {
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid name '%s' in the archive", name)
+	}
+	return filepath.Join(dest, clean), nil
+}
+
+// checkMemberParents refuses a member path below a symlink of dest. The check of
+// memberPath is only lexical, a symlink member followed by a member under it, e.g.
+// a -> /etc and a/passwd, would write outside dest.
+func checkMemberParents(dest string, path string, name string) error {
+	rel, e := filepath.Rel(dest, filepath.Dir(path))
+	if e != nil || rel == "." {
+		return e
+	}
+	dir := dest
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		info, e := os.Lstat(dir)
+		if os.IsNotExist(e) {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("invalid name '%s' in the archive, it is below the symlink '%s'", name, dir)
+		}
+	}
+	return nil
+}
+
+// extractArchive extracts an archive written by writeArchive into the existing
+// directory dest. It returns the metadata that could not be kept.
+func extractArchive(r io.Reader, dest string) ([]string, error) {
+	var lost []string
+	var dirs []*tar.Header
+	tr := tar.NewReader(r)
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return lost, e
+		}
+		path, e := memberPath(dest, hdr.Name)
+		if e != nil {
+			return lost, e
+		}
+		if e = checkMemberParents(dest, path, hdr.Name); e != nil {
+			return lost, e
+		}
+		// A later member replaces a symlink of the same name instead of following it
+		if info, e := os.Lstat(path); e == nil && info.Mode()&os.ModeSymlink != 0 {
+			os.Remove(path)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if e = os.MkdirAll(path, 0700); e != nil {
+				return lost, e
+			}
+			// Directory times are set last, extracting their content changes them
+			dirs = append(dirs, hdr)
+			continue
+		case tar.TypeSymlink:
+			os.Remove(path)
+			if e = os.Symlink(hdr.Linkname, path); e != nil {
+				return lost, e
+			}
+		case tar.TypeReg:
+			e = writeMember(tr, path)
+			if e != nil {
+				return lost, e
+			}
+		default:
+			continue
+		}
+		lost = append(lost, applyHeader(path, hdr)...)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path, _ := memberPath(dest, dirs[i].Name)
+		// A later member may have replaced the directory
+		if info, e := os.Lstat(path); e != nil || info.IsDir() == false {
+			continue
+		}
+		lost = append(lost, applyHeader(path, dirs[i])...)
+	}
+	return lost, nil
+}
+
+func writeMember(r io.Reader, path string) error {
+	f, e := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|unix.O_NOFOLLOW, 0600)
+	if e != nil {
+		return e
+	}
+	_, e = io.Copy(f, r)
+	if e == nil {
+		e = f.Sync()
+	}
+	if e != nil {
+		f.Close()
+		return e
+	}
+	return f.Close()
+}
+
+// applyHeader sets the owner, mode, extended attributes and times of an archive
+// member on path, like copyMetadata. It returns what could not be kept.
+func applyHeader(path string, hdr *tar.Header) []string {
+	var lost []string
+	e := os.Lchown(path, hdr.Uid, hdr.Gid)
+	if e != nil {
+		lost = append(lost, fmt.Sprintf("owner %d:%d of %s (%v)", hdr.Uid, hdr.Gid, hdr.Name, unwrapPathError(e)))
+	}
+	mode := hdr.FileInfo().Mode()
+	if hdr.Typeflag != tar.TypeSymlink {
+		e = os.Chmod(path, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		if e != nil {
+			lost = append(lost, fmt.Sprintf("mode %v of %s (%v)", mode.Perm(), hdr.Name, unwrapPathError(e)))
+		}
+	}
+	for key, value := range hdr.PAXRecords {
+		if strings.HasPrefix(key, xattrPAXPrefix) == false {
+			continue
+		}
+		name := strings.TrimPrefix(key, xattrPAXPrefix)
+		if e = unix.Lsetxattr(path, name, []byte(value), 0); e != nil {
+			lost = append(lost, fmt.Sprintf("%s of %s (%v)", describeXattr(name), hdr.Name, e))
+		}
+	}
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+	e = unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+	if e != nil {
+		lost = append(lost, fmt.Sprintf("access and modification time of %s (%v)", hdr.Name, e))
+	}
+	return lost
+}
+
+// readArchiveFiles returns the content of the regular files of an archive by name.
+func readArchiveFiles(r io.Reader) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			return files, nil
+		}
+		if e != nil {
+			return nil, e
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, e := io.ReadAll(tr)
+		if e != nil {
+			return nil, e
+		}
+		files[hdr.Name] = data
+	}
+}
+
+// readTreeFiles returns the content of the regular files of a directory by their
+// path relative to root, like readArchiveFiles.
+func readTreeFiles(root string) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	e := walkTree(root, func(path string, rel string, d fs.DirEntry) error {
+		if d.Type().IsRegular() == false {
+			return nil
+		}
+		data, e := os.ReadFile(path)
+		if e != nil {
+			return e
+		}
+		files[filepath.ToSlash(rel)] = data
+		return nil
+	})
+	return files, e
+}
+
+// findArchiveMember returns the header of member and a reader of its content.
+func findArchiveMember(r io.Reader, member string) (*tar.Header, io.Reader, error) {
+	member = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(member)), "/")
+	tr := tar.NewReader(r)
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			return nil, nil, fmt.Errorf("'%s' is not in the archive", member)
+		}
+		if e != nil {
+			return nil, nil, e
+		}
+		if hdr.Name == member && hdr.Typeflag == tar.TypeReg {
+			return hdr, tr, nil
+		}
+	}
+}
+
+// carryLeftOut moves what was left out of a directory backup from the old content
+// of a restored directory to the directory, so restoring keeps it.
+func carryLeftOut(old string, dir string) error {
+	ignore, e := readIgnoreFile(old)
+	if e != nil {
+		return e
+	}
+	return filepath.WalkDir(old, func(path string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+		rel, _ := filepath.Rel(old, path)
+		if rel == "." || ignore.isLeftOut(rel, d) == false {
+			return nil
+		}
+		target := filepath.Join(dir, rel)
+		if e = os.MkdirAll(filepath.Dir(target), 0700); e != nil {
+			return e
+		}
+		os.RemoveAll(target)
+		if e = os.Rename(path, target); e != nil {
+			return e
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// swapDir puts the directory tmp in place of dir, both must be in the same file
+// system. They are exchanged atomically when the file system supports it. It
+// returns where the old content of dir is now.
+func swapDir(tmp string, dir string) (string, error) {
+	e := unix.Renameat2(unix.AT_FDCWD, tmp, unix.AT_FDCWD, dir, unix.RENAME_EXCHANGE)
+	if e == nil {
+		return tmp, nil
+	}
+	if e != unix.ENOENT && e != unix.EINVAL && e != unix.ENOSYS {
+		return "", e
+	}
+	old := tmp + ".old"
+	if e = os.Rename(dir, old); e != nil && os.IsNotExist(e) == false {
+		return "", e
+	}
+	if e = os.Rename(tmp, dir); e != nil {
+		os.Rename(old, dir)
+		return "", e
+	}
+	return old, nil
+}
+
+// archiveToFile writes the directory root as a tar archive to path, encoded with
+// encode. It returns the sha256 and the size of the archive and the files left out.
+func archiveToFile(root string, path string, encode string) (string, int64, []string, error) {
+	pr, pw := io.Pipe()
+	skipped := make(chan []string, 1)
+	go func() {
+		s, e := writeArchive(pw, root)
+		pw.CloseWithError(e)
+		skipped <- s
+	}()
+	counter := &countingReader{r: pr}
+	sum, e := copyReader(counter, path, encode, -1)
+	// Stops writeArchive when the copy failed
+	pr.CloseWithError(e)
+	return sum, counter.n, <-skipped, e
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, e := c.r.Read(p)
+	c.n += int64(n)
+	return n, e
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarOf returns an archive of the headers, regular files get their name as content.
+func tarOf(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		var content []byte
+		if hdr.Typeflag == tar.TypeReg {
+			content = []byte(hdr.Name)
+			hdr.Size = int64(len(content))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if e := tw.WriteHeader(hdr); e != nil {
+			t.Fatal(e)
+		}
+		if _, e := tw.Write(content); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := tw.Close(); e != nil {
+		t.Fatal(e)
+	}
+	return &buf
+}
+
+func TestExtractArchiveBelowSymlink(t *testing.T) {
+	outside := t.TempDir()
+	tests := [][]*tar.Header{
+		{
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "a/passwd", Typeflag: tar.TypeReg},
+		},
+		{
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "a/sub", Typeflag: tar.TypeDir, Mode: 0755},
+		},
+		{
+			{Name: "d", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "d/a", Typeflag: tar.TypeSymlink, Linkname: "../../" + filepath.Base(outside)},
+			{Name: "d/a/passwd", Typeflag: tar.TypeReg},
+		},
+	}
+	for i, headers := range tests {
+		dest := t.TempDir()
+		if _, e := extractArchive(tarOf(t, headers...), dest); e == nil {
+			t.Errorf("archive %d: extracting below a symlink succeeded", i)
+		}
+		entries, _ := os.ReadDir(outside)
+		if len(entries) != 0 {
+			t.Fatalf("archive %d wrote outside the destination: %v", i, entries)
+		}
+	}
+}
+
+func TestExtractArchiveReplacesSymlink(t *testing.T) {
+	outside := t.TempDir()
+	target := filepath.Join(outside, "passwd")
+	if e := os.WriteFile(target, []byte("root"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	dest := t.TempDir()
+	archive := tarOf(t,
+		&tar.Header{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: target},
+		&tar.Header{Name: "passwd", Typeflag: tar.TypeReg},
+	)
+	if _, e := extractArchive(archive, dest); e != nil {
+		t.Fatal(e)
+	}
+	if data, _ := os.ReadFile(target); string(data) != "root" {
+		t.Errorf("the file outside the destination has %q", data)
+	}
+	info, e := os.Lstat(filepath.Join(dest, "passwd"))
+	if e != nil || info.Mode().IsRegular() == false {
+		t.Errorf("passwd is not a regular file: %v", e)
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	dest := t.TempDir()
+	archive := tarOf(t,
+		&tar.Header{Name: "etc", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "etc/nginx.conf", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "nginx.conf"},
+	)
+	if _, e := extractArchive(archive, dest); e != nil {
+		t.Fatal(e)
+	}
+	data, e := os.ReadFile(filepath.Join(dest, "etc", "link"))
+	if e != nil || string(data) != "etc/nginx.conf" {
+		t.Errorf("etc/link has %q, %v", data, e)
+	}
+}
+
+func TestMemberPath(t *testing.T) {
+	for _, name := range []string{"/etc/passwd", "..", "../x", "a/../../x"} {
+		if _, e := memberPath("/tmp/dest", name); e == nil {
+			t.Errorf("memberPath accepts %q", name)
+		}
+	}
+	if path, e := memberPath("/tmp/dest", "a/./b"); e != nil || path != "/tmp/dest/a/b" {
+		t.Errorf("memberPath(a/./b) = %q, %v", path, e)
+	}
+}
@@ -1,10 +1,11 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
 	"os"
-	"sort"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -19,14 +20,46 @@ func init() {
 	backUpCmd.AddCommand(deleteBackupCmd)
 	takeBackupCmd.Flags().StringP("dir", "d", "", "Enter the directory of the file, absolute directory not relative.")
 	takeBackupCmd.Flags().StringP("file", "f", "", "Enter the filename")
-	takeBackupCmd.MarkFlagRequired("file")
+	takeBackupCmd.Flags().StringP("compress", "c", "", "Compress the backup. Available options are none, gzip and zstd. Default is taken from the config file.")
+	takeBackupCmd.Flags().BoolP("encrypt", "e", false, "Encrypt the backup with age to the recipients or the passphrase of LINATE_AGE_RECIPIENTS, LINATE_PASSPHRASE or the config file. Default is backup.encrypt in the config file.")
+	takeBackupCmd.Flags().Bool("dedup", false, "Keep the backup as deduplicated chunks in the backup store. Default is backup.dedup in the config file.")
+	takeBackupCmd.Flags().BoolP("recursive", "r", false, "Back up a directory and everything in it as a tar archive. Files matching .linateignore in the directory are left out.")
+	takeBackupCmd.Flags().String("profile", "", "Back up every file of this profile of the config file as one set.")
+	takeBackupCmd.Flags().String("note", "", "Note why the backup is taken, e.g. \"before TLS rotation\". bk check shows it.")
+	takeBackupCmd.Flags().StringSlice("tag", nil, "Tag the backup, e.g. change-1234. Repeat the flag or separate tags with commas.")
+	takeBackupCmd.Flags().Bool("wait", false, "Wait for another linate taking a backup in the same directory or store instead of failing.")
+	takeBackupCmd.Flags().String("timeout", "", "Wait at most this long for another linate, e.g. 30s or 5m. Implies --wait.")
+	takeBackupCmd.Flags().Bool("prune", false, "Prune old backups according to the retention policy without asking when the backup does not fit in a quota or in the free space.")
+	takeBackupCmd.Flags().Bool("history", false, "Commit the file to the git history of the directory or the backup store instead of taking a backup file, see bk history. Default is backup.history in the config file.")
+	takeBackupCmd.Flags().Bool("modified-conffiles", false, "Back up every config file of a dpkg or rpm package that has been changed locally. Needs a backup store.")
+	takeBackupCmd.MarkFlagsOneRequired("file", "profile", "modified-conffiles")
+	takeBackupCmd.MarkFlagsMutuallyExclusive("file", "profile", "modified-conffiles")
+	takeBackupCmd.MarkFlagsMutuallyExclusive("recursive", "profile")
+	takeBackupCmd.MarkFlagsMutuallyExclusive("recursive", "modified-conffiles")
+	addStoreFlag(takeBackupCmd)
+	addTargetFlag(takeBackupCmd)
+	takeBackupCmd.MarkFlagsMutuallyExclusive("profile", "target")
+	takeBackupCmd.MarkFlagsMutuallyExclusive("modified-conffiles", "target")
+	for _, flag := range []string{"recursive", "compress", "dedup", "encrypt", "profile", "modified-conffiles", "target"} {
+		takeBackupCmd.MarkFlagsMutuallyExclusive(flag, "history")
+	}
 	checkBackupCmd.Flags().StringP("dir", "d", "", "Enter the directory of the file, absolute directory not relative.")
 	checkBackupCmd.Flags().StringP("file", "f", "", "Enter the filename")
+	checkBackupCmd.Flags().String("tag", "", "Only show the backups with this tag.")
 	checkBackupCmd.MarkFlagRequired("file")
+	addStoreFlag(checkBackupCmd)
+	addTargetFlag(checkBackupCmd)
 	deleteBackupCmd.Flags().StringP("dir", "d", "", "Enter the directory of the file, absolute directory not relative.")
 	deleteBackupCmd.Flags().StringP("file", "f", "", "Enter the filename")
-	deleteBackupCmd.Flags().IntP("number", "n", 1, "How many backups you want to delete. The oldest one will be deleted first.")
+	deleteBackupCmd.Flags().IntP("number", "n", 1, "How many backups you want to delete. The oldest one will be deleted first. Without filters the default is 1.")
+	deleteBackupCmd.Flags().String("older-than", "", "Only delete backups older than this, e.g. 12h, 30d or 2w.")
+	deleteBackupCmd.Flags().String("before", "", "Only delete backups taken before this date (YYYY-MM-DD).")
+	deleteBackupCmd.Flags().String("name", "", "Only delete backups whose name matches this glob, e.g. '*.gz'.")
+	deleteBackupCmd.Flags().Int("keep", 0, "Never delete the newest n backups.")
+	deleteBackupCmd.Flags().Bool("dry-run", false, "Only show the backups that would be deleted.")
+	deleteBackupCmd.Flags().BoolP("yes", "y", false, "Do not ask for confirmation, e.g. for cron.")
 	deleteBackupCmd.MarkFlagRequired("file")
+	addStoreFlag(deleteBackupCmd)
 }
 
 var backUpCmd = &cobra.Command{
@@ -38,8 +71,13 @@ var backUpCmd = &cobra.Command{
 var takeBackupCmd = &cobra.Command{
 	Use:   "take",
 	Short: "Take backup.",
-	Long:  `Take backup. Backup filename will be <filename>-<year><month><day>-<serialnumber> in the same directory.`,
-	Run:   take_backup,
+	Long: `Take backup. Backup filename will be <filename>-<yyyymmdd>T<hhmmss>-<serialnumber> in the same directory,
+or in the mirrored directory of the backup store when --store is used. Compressed backups get a .gz or .zst extension.
+A directory is backed up with --recursive as a tar archive with a .tar extension. With --profile every file of a
+profile of the config file is backed up as one set, see bk profile. With --modified-conffiles every config file of a
+package that has been changed locally is backed up, see bk conffiles. With --history the file is committed to a git
+history instead, see bk history.`,
+	Run: take_backup,
 }
 
 var checkBackupCmd = &cobra.Command{
@@ -52,121 +90,405 @@ var checkBackupCmd = &cobra.Command{
 var deleteBackupCmd = &cobra.Command{
 	Use:   "delete",
 	Short: "Delete the backup files.",
-	Long:  `Delete the backup files. The oldest one will be deleted first.`,
-	Run:   delete_backup,
+	Long: `Delete the backup files. The oldest one will be deleted first. Backups are chosen with --older-than, --before
+and --name, all of them must match, and the newest --keep backups are never deleted. Without any of them the oldest
+--number backups are deleted. The exit status is 0 when every chosen backup has been deleted, 2 when some could not be
+deleted and 3 when there is nothing to delete.`,
+	Run: delete_backup,
 }
 
 type FileInfo struct {
-	Name    string
-	Size    string
-	ModTime string
-	Owner   string
+	Name         string
+	Size         string
+	OriginalSize string
+	ModTime      string
+	Owner        string
+	Encrypted    string
+	Note         string
 }
 
 var currDir, _ = os.Getwd()
 
 func take_backup(cmd *cobra.Command, args []string) {
-	var filePath string
-	year, month, day := time.Now().Date()
-	newFileName := ""
-	var fn string
+	var newFileName string
+	var lost []string
 	var e error
-	dir, _ := cmd.Flags().GetString("dir")
-	if dir == "" {
-		dir = currDir
+	if profile, _ := cmd.Flags().GetString("profile"); profile != "" {
+		store := getStore(cmd)
+		takeProfile(profile, getTakeOptions(cmd, store), store)
+		return
+	}
+	if conffiles, _ := cmd.Flags().GetBool("modified-conffiles"); conffiles {
+		store := getStore(cmd)
+		takeConffiles(getTakeOptions(cmd, store), store)
+		return
+	}
+	loc := getBackupLocation(cmd)
+	recursive, _ := cmd.Flags().GetBool("recursive")
+
+	f := fileExists(loc.Source())
+	if f == false {
+		exitWithError(fmt.Sprintf("File '%s' does not exist in the directory %v or follows a strict permission. Please run as the superuser if the file really exists.\n", loc.File, loc.Dir))
+	}
+	isDir := dirExists(loc.Source() + "/")
+	if history, _ := cmd.Flags().GetBool("history"); isDir && history {
+		exitWithError(fmt.Sprintf("'%s' is a directory. The history only keeps files, please remove the --history flag.\n", loc.Source()))
+	}
+	if isDir && recursive == false {
+		exitWithError(fmt.Sprintf("'%s' is a directory. Please use the --recursive flag to back it up as a tar archive.\n", loc.Source()))
+	}
+	if isDir == false && recursive {
+		exitWithError(fmt.Sprintf("'%s' is not a directory. Please remove the --recursive flag to back up a file.\n", loc.Source()))
 	}
-	file, _ := cmd.Flags().GetString("file")
 
-	d := dirExists(dir)
-	if d == false {
-		exitWithError(fmt.Sprintf("Directory '%s' does not exist or follows a strict permission. Please run as the superuser if the directory really exists.\n", dir))
+	if useHistory(cmd) {
+		note, tags := getNoteAndTags(cmd)
+		takeHistory(loc, note, tags)
+		return
 	}
 
-	// Add forward slash after dir
-	if dir[len(dir)-1:] == "/" {
-		filePath = dir + file
-	} else {
-		filePath = dir + "/" + file
-		dir = dir + "/"
+	// The manifest of the target is enough to name the backup, push renames it
+	// when another linate uploaded the name meanwhile
+	session := getTargetSession(cmd)
+	if session != nil {
+		loc.Store = session.staging
+	}
+	opts := getTakeOptions(cmd, loc.Store)
+	opts.Recursive = recursive
+	if session != nil && opts.Dedup {
+		// Chunks are shared by the backups of a store, a target only gets whole files
+		if cmd.Flags().Changed("dedup") {
+			session.close()
+			exitWithError("Deduplicated backups can not be kept in a target. Please remove the --dedup flag.\n")
+		}
+		opts.Dedup = false
 	}
 
-	f := fileExists(filePath)
-	if f == false {
-		exitWithError(fmt.Sprintf("File '%s' does not exist in the directory %v or follows a strict permission. Please run as the superuser if the file really exists.\n", file, dir))
+	if session != nil {
+		// The staged backups do not stay on this disk
+		opts.SkipQuota = true
 	}
 
-	// Choose a filename
-	for i := 1; i < 100; i++ {
-		fn = fmt.Sprintf("%s-%d%s%d-%d", file, year, month, day, i)
-		_, e = os.Stat(dir + fn)
+	// Offer to make room before taking the backup
+	var quota *quotaError
+	if e = checkSpace(loc, opts); errors.As(e, &quota) {
+		prune, _ := cmd.Flags().GetBool("prune")
+		fmt.Printf("%sThe backup does not fit, %v%s\n", colors["yellow"], quota, colors["reset"])
+		if pruneForQuota(quota, loc.Store, prune) == false {
+			if session != nil {
+				session.close()
+			}
+			exitWithError(fmt.Sprintf("%sThe backup has not been taken. Please free some space, prune the backups with bk prune or raise the quota in the config file.%s\n", colors["red"], colors["reset"]))
+		}
+	}
+
+	newFileName, lost, e = createBackup(loc, opts)
+	if e != nil && session != nil {
+		session.close()
+	}
+	exitOnHookError(e, "The backup has not been taken.")
+	exitOnLockError(e, "The backup has not been taken.")
+	exitOnQuotaError(e, "The backup has not been taken.")
+	if e != nil {
+		exitWithError(fmt.Sprintf("%sCan not create the backup file. Please run as the superuser if your user does not have permission to create a file in this directory. %v%s\n", colors["red"], e, colors["reset"]))
+	}
+	if session != nil {
+		uploaded, e := session.push()
 		if e != nil {
-			newFileName = fn
-			break
+			session.keep()
+			exitWithError(fmt.Sprintf("%sCan not upload the backup to the target '%s', it is kept in '%s'. %v%s\n", colors["red"], session.target, session.staging.Root, e, colors["reset"]))
+		}
+		session.close()
+		if len(uploaded) > 0 {
+			newFileName = uploaded[0]
 		}
 	}
-	if newFileName == "" {
-		exitWithError("It seems like there are already 99 backups.\n")
+	fmt.Printf("%slinate successfully created a backup file '%s'%s\n", colors["green"], newFileName, colors["reset"])
+	printLostMetadata(lost)
+}
+
+// getNoteAndTags reads the --note and --tag flags of bk take.
+func getNoteAndTags(cmd *cobra.Command) (string, []string) {
+	note, _ := cmd.Flags().GetString("note")
+	var tags []string
+	raw, _ := cmd.Flags().GetStringSlice("tag")
+	for _, tag := range raw {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && arrContains(tags, tag) == false {
+			tags = append(tags, tag)
+		}
 	}
+	return note, tags
+}
 
-	// Copy the old file to the backup file
-	e = copyFile(dir+file, dir+newFileName)
+// getTakeOptions reads the --compress, --dedup, --encrypt, --note, --tag, --wait and
+// --timeout flags of bk take, the config file gives the defaults.
+func getTakeOptions(cmd *cobra.Command, store *backupStore) backupOptions {
+	var opts backupOptions
+	opts.Note, opts.Tags = getNoteAndTags(cmd)
+	if wait, _ := cmd.Flags().GetBool("wait"); wait {
+		opts.Wait = -1
+	}
+	if timeout, _ := cmd.Flags().GetString("timeout"); timeout != "" {
+		var e error
+		opts.Wait, e = time.ParseDuration(timeout)
+		if e != nil || opts.Wait <= 0 {
+			exitWithError(fmt.Sprintf("Invalid timeout '%s'. Please use a duration like 30s or 5m.\n", timeout))
+		}
+	}
+	opts.Compression, _ = cmd.Flags().GetString("compress")
+	opts.Dedup, _ = cmd.Flags().GetBool("dedup")
+	if opts.Compression == "" {
+		opts.Compression = getConfig().Backup.Compress
+	}
+	if validCompression(opts.Compression) == false {
+		exitWithError(fmt.Sprintf("Unknown compression '%s'. Available options are none, gzip and zstd.\n", opts.Compression))
+	}
+	if cmd.Flags().Changed("dedup") == false {
+		opts.Dedup = getConfig().Backup.Dedup && store != nil
+	}
+	if opts.Dedup && store == nil {
+		exitWithError("--dedup needs a backup store. Please use the --store flag or set backup.store in the config file.\n")
+	}
+	opts.Encrypt, _ = cmd.Flags().GetBool("encrypt")
+	if cmd.Flags().Changed("encrypt") == false {
+		opts.Encrypt = getConfig().Backup.Encrypt
+	}
+	if opts.Encrypt && opts.Dedup {
+		exitWithError("Deduplicated backups can not be encrypted, their chunks are shared. Please choose --encrypt or --dedup.\n")
+	}
+	if opts.Encrypt {
+		if _, e := encryptionRecipients(); e != nil {
+			exitWithError(fmt.Sprintf("Can not encrypt the backup, %v.\n", e))
+		}
+	}
+	return opts
+}
+
+// backupOptions changes how createBackup takes a backup.
+type backupOptions struct {
+	Compression string
+	// Recursive backs up a directory as a tar archive
+	Recursive bool
+	// From is copied instead of the file when it is set, bk watch keeps the
+	// previous content of a file there
+	From string
+	// Dedup keeps the backup as chunks of the store, Compression is ignored
+	Dedup bool
+	// Encrypt encrypts the backup with age, it can not be used with Dedup
+	Encrypt bool
+	// Time is when the backup is taken, now when it is zero. The backups of a
+	// profile set share it
+	Time time.Time
+	// Profile and Set are recorded for the backups of a profile, see takeProfile
+	Profile string
+	Set     string
+	// Wait is how long to wait for another linate taking a backup in the same
+	// directory, see lockDir. bk take only waits with --wait
+	Wait time.Duration
+	// SkipQuota leaves out the quotas of the config file, the free space of the
+	// filesystem is still checked
+	SkipQuota bool
+	// Note and Tags tell why the backup is taken, they are kept in the manifest
+	Note string
+	Tags []string
+}
+
+// defaultOptions returns the options of the backups linate takes on its own, like
+// the backup of the current file before a restore.
+func defaultOptions(store *backupStore) backupOptions {
+	cfg := getConfig().Backup
+	opts := backupOptions{Compression: cfg.Compress, Dedup: cfg.Dedup && store != nil, Encrypt: cfg.Encrypt, Wait: -1}
+	// Encryption wins, it protects the content
+	if opts.Encrypt {
+		opts.Dedup = false
+	}
+	return opts
+}
+
+// backupNameTaken reports whether a backup named like fn, with any compression,
+// exists in dir or is one of the recorded paths. The serial number is shared by
+// compressed and plain backups.
+func backupNameTaken(dir string, fn backupName, recorded map[string]bool) bool {
+	for _, c := range []string{"", "gzip", "zstd", "dedup"} {
+		fn.Compression = c
+		for _, encrypted := range []bool{false, true} {
+			fn.Encrypted = encrypted
+			if fileExists(dir+fn.String()) || recorded[dir+fn.String()] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// createBackup copies the file, or archives the directory, to the next free backup
+// name and returns the path of the backup along with the metadata that could not be
+// kept. Backups in a store are added to its manifest. The hooks run without the
+// lock, a hook may run bk take or bk prune on the same directory.
+func createBackup(loc backupLocation, opts backupOptions) (string, []string, error) {
+	if e := runHooks(hookPreTake, hookEnv{Source: loc.Source(), Store: loc.Store}); e != nil {
+		return "", nil, e
+	}
+	path, sum, lost, e := writeBackup(loc, opts)
 	if e != nil {
-		exitWithError(fmt.Sprintf("%sCan not create the backup file. Please run as the superuser if your user does not have permission to create a file in this directory.%s\n", colors["red"], colors["reset"]))
+		return "", nil, e
 	}
-	fmt.Printf("%slinate successfully created a backup file '%s'%s\n", colors["green"], newFileName, colors["reset"])
+	runPostHooks(hookPostTake, hookEnv{Source: loc.Source(), Backup: path, Checksum: sum, Store: loc.Store})
+	return path, lost, nil
 }
 
-func check_backup(cmd *cobra.Command, args []string) {
-	var e error
-	dir, _ := cmd.Flags().GetString("dir")
-	if dir == "" {
-		dir = currDir
+// writeBackup takes the backup of createBackup under the lock of the directory or
+// store and returns its path, its checksum and the metadata that could not be kept.
+func writeBackup(loc backupLocation, opts backupOptions) (string, string, []string, error) {
+	now := opts.Time
+	if now.IsZero() {
+		now = time.Now()
 	}
-	fileName, _ := cmd.Flags().GetString("file")
-	d := dirExists(dir)
-	if d == false {
-		exitWithError(fmt.Sprintf("Directory '%s' does not exist or follows a strict permission. Please run as the superuser if the directory really exists.\n", dir))
+	dir := loc.BackupDir()
+	newFileName := ""
+	var fn backupName
+
+	if loc.Store != nil {
+		if e := os.MkdirAll(dir, 0700); e != nil {
+			return "", "", nil, e
+		}
 	}
+	// Backups taken at the same time would write the same manifest
+	lock, e := lockDir(loc.index().Root, opts.Wait)
+	if e != nil {
+		return "", "", nil, e
+	}
+	defer lock.unlock()
 
-	// Add forward slash after dir
-	if dir[len(dir)-1:] != "/" {
-		dir = dir + "/"
+	if e := checkSpace(loc, opts); e != nil {
+		return "", "", nil, e
+	}
+	if opts.Dedup {
+		if loc.Store == nil {
+			return "", "", nil, errors.New("deduplicated backups need a backup store")
+		}
+		opts.Compression = "dedup"
+		if e := os.MkdirAll(filepath.Join(loc.Store.Root, chunkDirName), 0700); e != nil {
+			return "", "", nil, e
+		}
 	}
-	files, e := ioutil.ReadDir(dir)
+
+	// Choose a filename. A name in the manifest is taken even when its backup is
+	// missing, e.g. kept in a target. An empty file reserves it until the backup
+	// replaces it, in case a linate without the lock, e.g. on NFS, chooses at the
+	// same time
+	recorded, e := loc.index().recordedPaths()
+	if e != nil {
+		return "", "", nil, e
+	}
+	for i := 1; newFileName == ""; i++ {
+		fn = newBackupName(loc.File, now, i, opts.Compression)
+		fn.Archive = opts.Recursive
+		fn.Encrypted = opts.Encrypt
+		if backupNameTaken(dir, fn, recorded) {
+			continue
+		}
+		f, e := os.OpenFile(dir+fn.String(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(e, fs.ErrExist) {
+			continue
+		}
+		if e != nil {
+			return "", "", nil, e
+		}
+		f.Close()
+		newFileName = fn.String()
+	}
+	// The reservation is no backup, it must not stay behind when linate is interrupted
+	stop := removeOnInterrupt(dir + newFileName)
+	defer stop()
+
+	// Copy the old file to the backup file
+	var sum string
+	var size int64
+	var lost []string
+	encoding := fn.encoding()
+	if opts.Recursive {
+		var skipped []string
+		sum, _, e = atomicWrite(dir+newFileName, encoding, "", func(tmp string) (string, error) {
+			var sum string
+			var e error
+			sum, size, skipped, e = archiveToFile(loc.Source(), tmp, encoding)
+			return sum, e
+		})
+		for _, s := range skipped {
+			lost = append(lost, fmt.Sprintf("%s (sockets and devices are left out)", s))
+		}
+	} else {
+		src := loc.Source()
+		if opts.From != "" {
+			src = opts.From
+		}
+		if info, e := os.Stat(src); e == nil {
+			size = info.Size()
+		}
+		sum, lost, e = atomicCopyFile(src, dir+newFileName, "", encoding)
+	}
+	if e != nil {
+		os.Remove(dir + newFileName)
+		return "", "", nil, e
+	}
+	// Record the checksum so bk verify can find changes to the backup
+	record := manifestRecord{
+		Source:   loc.Source(),
+		Time:     now.Truncate(time.Second),
+		Size:     size,
+		Checksum: sum,
+		Profile:  opts.Profile,
+		Set:      opts.Set,
+		Note:     opts.Note,
+		Tags:     opts.Tags,
+	}
+	if info, e := os.Stat(dir + newFileName); e == nil {
+		record.ModTime = info.ModTime()
+	}
+	if opts.Encrypt {
+		// bk verify can check it without the key
+		record.StoredChecksum, _ = hashFile(dir+newFileName, "")
+	}
+	record.User, _ = getCurrentUser()
+	index := loc.index()
+	record.Path = index.relPath(dir + newFileName)
+	e = index.addRecord(record)
+	if e != nil {
+		os.Remove(dir + newFileName)
+		return "", "", nil, e
+	}
+	stop()
+	return dir + newFileName, sum, lost, nil
+}
+
+func check_backup(cmd *cobra.Command, args []string) {
+	tag, _ := cmd.Flags().GetString("tag")
+	loc := getBackupLocation(cmd)
+	if session := getTargetSession(cmd); session != nil {
+		defer session.close()
+		loc.Store = session.staging
+		if e := session.fetch(loc.Source()); e != nil {
+			session.close()
+			exitWithError(fmt.Sprintf("Can not read the backups of '%s' in the target '%s'. %v\n", loc.Source(), session.target, e))
+		}
+	}
+	files, e := loc.list()
 	if e != nil {
 		fmt.Println(e)
 		return
 	}
+	if tag != "" {
+		files = withTag(files, tag)
+	}
 
-	// Sort by date modified
-	sort.Slice(files, func(i, j int) bool {
-		return files[j].ModTime().Before(files[i].ModTime())
-	})
-
+	// Newest first
 	var backups = make([]FileInfo, len(files))
 	counter := 0
-	var fn []string
-	var tm time.Time
 	for _, file := range files {
-		// If file is a directory ignore
-		if file.IsDir() == true {
-			continue
-		}
-		// Check the filename
-		fn = strings.Split(fmt.Sprintf("%s", file.Name()), "-")
-		if len(fn) == 3 && fn[0] == fileName {
-			tm = file.ModTime()
-			backups[counter].Name = file.Name()
-			backups[counter].Size = fmt.Sprintf("%v byte", file.Size())
-			backups[counter].ModTime = fmt.Sprintf("%v-%v-%v | %v:%v", tm.Year(), tm.Month(), tm.Day(), tm.Hour(), tm.Minute())
-			ow, e := getFileOwner(dir + file.Name())
-			if e == nil {
-				backups[counter].Owner = ow
-			} else {
-				backups[counter].Owner = "ERROR"
-			}
-			counter += 1
-		}
+		backups[counter] = newFileInfo(file)
+		counter += 1
 	}
 
 	// Show 100 backups at most
@@ -177,99 +499,131 @@ func check_backup(cmd *cobra.Command, args []string) {
 
 	if viewLength == 0 {
 		fmt.Printf("No backup found\n")
-		os.Exit(0)
+		printScheduleRuns(loc.Source())
+		return
 	}
 	fmt.Printf("Total number of backups:%s %d%s\n", colors["yellow"], counter, colors["reset"])
 
-	// Create the table view
+	printBackupTable(backups[:viewLength])
+
+	// Deduplicated backups share their chunks
+	for _, file := range files {
+		if file.Compression == "dedup" {
+			logical, physical := chunkUsage(files)
+			fmt.Printf("\nLogical size:%s %s%s, physical size:%s %s%s\n", colors["yellow"], formatSize(logical), colors["reset"], colors["yellow"], formatSize(physical), colors["reset"])
+			break
+		}
+	}
+	printScheduleRuns(loc.Source())
+}
+
+// printBackupTable prints backups as the table view of bk check.
+func printBackupTable(backups []FileInfo) {
 	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
 	columnFmt := color.New(color.FgYellow).SprintfFunc()
-	tbl := table.New("File Name", "Size", "Date | Time", "Owner")
+	tbl := table.New("File Name", "Size", "Original Size", "Date | Time", "Owner", "Encrypted", "Note")
 	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
-	for i := 0; i < viewLength; i++ {
-		tbl.AddRow(backups[i].Name, backups[i].Size, backups[i].ModTime, backups[i].Owner)
+	for i := range backups {
+		tbl.AddRow(backups[i].Name, backups[i].Size, backups[i].OriginalSize, backups[i].ModTime, backups[i].Owner, backups[i].Encrypted, backups[i].Note)
 	}
 	tbl.Print()
 }
 
+// Exit codes of bk delete
+const (
+	deleteDone    = 0
+	deletePartial = 2
+	deleteNothing = 3
+)
+
 func delete_backup(cmd *cobra.Command, args []string) {
 	var e error
-	dir, _ := cmd.Flags().GetString("dir")
-	if dir == "" {
-		dir = currDir
-	}
-	fileName, _ := cmd.Flags().GetString("file")
 	number, _ := cmd.Flags().GetInt("number")
-	d := dirExists(dir)
-	if d == false {
-		exitWithError(fmt.Sprintf("Directory '%s' does not exist or follows a strict permission. Please run as the superuser if the directory really exists.\n", dir))
+	rawAge, _ := cmd.Flags().GetString("older-than")
+	before, _ := cmd.Flags().GetString("before")
+	pattern, _ := cmd.Flags().GetString("name")
+	keep, _ := cmd.Flags().GetInt("keep")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	yes, _ := cmd.Flags().GetBool("yes")
+	if number < 0 || keep < 0 {
+		exitWithError("The number of backups can not be negative.\n")
 	}
-	if dir[len(dir)-1:] != "/" {
-		dir = dir + "/"
+	var maxAge time.Duration
+	if rawAge != "" {
+		maxAge, e = parseAge(rawAge)
+		if e != nil {
+			exitWithError(fmt.Sprintf("Invalid age '%s'. Please use an age like 12h, 30d or 2w.\n", rawAge))
+		}
+	}
+	var beforeDate time.Time
+	if before != "" {
+		beforeDate, e = time.ParseInLocation("2006-01-02", before, time.Local)
+		if e != nil {
+			exitWithError(fmt.Sprintf("Invalid date '%s'. Please use the YYYY-MM-DD format.\n", before))
+		}
+	}
+	if _, e = filepath.Match(pattern, ""); e != nil {
+		exitWithError(fmt.Sprintf("Invalid pattern '%s'. %v\n", pattern, e))
+	}
+	if yes == false && dryRun == false && isTerminal(os.Stdin) == false {
+		exitWithError("Can not ask for confirmation, the input is not a terminal. Please use --yes to delete or --dry-run to only show the backups.\n")
 	}
 
-	files, e := ioutil.ReadDir(dir)
+	loc := getBackupLocation(cmd)
+	files, e := loc.list()
 	if e != nil {
 		fmt.Println(e)
 		return
 	}
 
-	// Sort by date modified
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].ModTime().Before(files[j].ModTime())
-	})
-
-	var backups = make([]FileInfo, len(files))
-	counter := 0
-	var fn []string
-	var tm time.Time
-	for _, file := range files {
-		if file.IsDir() == true {
+	// Choose the files, oldest first
+	filtered := rawAge != "" || before != "" || pattern != ""
+	limit := -1
+	if cmd.Flags().Changed("number") || (filtered == false && keep == 0) {
+		limit = number
+	}
+	now := time.Now()
+	var backups []FileInfo
+	var chosen []backupFile
+	for i := len(files) - 1; i >= keep && limit != len(chosen); i-- {
+		b := files[i]
+		if rawAge != "" && now.Sub(b.takenAt()) <= maxAge {
 			continue
 		}
-		// Choose the files, oldest first
-		fn = strings.Split(fmt.Sprintf("%s", file.Name()), "-")
-		if len(fn) == 3 && fn[0] == fileName {
-			tm = file.ModTime()
-			backups[counter].Name = file.Name()
-			backups[counter].Size = fmt.Sprintf("%v byte", file.Size())
-			backups[counter].ModTime = fmt.Sprintf("%v-%v-%v | %v:%v", tm.Year(), tm.Month(), tm.Day(), tm.Hour(), tm.Minute())
-			ow, e := getFileOwner(dir + file.Name())
-			if e == nil {
-				backups[counter].Owner = ow
-			} else {
-				backups[counter].Owner = "ERROR"
-			}
-			counter += 1
+		if before != "" && !b.takenAt().Before(beforeDate) {
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, b.Name); pattern != "" && ok == false {
+			continue
 		}
+		backups = append(backups, newFileInfo(b))
+		chosen = append(chosen, b)
 	}
-
-	toDelete := number
-	if number > counter {
-		toDelete = counter
+	if len(chosen) == 0 {
+		fmt.Printf("Nothing to delete\n")
+		os.Exit(deleteNothing)
 	}
-	fmt.Printf("%sFollowing %d backup file(s) will be deleted%s\n\n", colors["red"], toDelete, colors["reset"])
 
-	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
-	columnFmt := color.New(color.FgYellow).SprintfFunc()
-	tbl := table.New("File Name", "Size", "Date | Time", "Owner")
-	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
-
-	for i := 0; i < toDelete; i++ {
-		tbl.AddRow(backups[i].Name, backups[i].Size, backups[i].ModTime, backups[i].Owner)
+	if dryRun {
+		fmt.Printf("%sFollowing %d backup file(s) would be deleted%s\n\n", colors["yellow"], len(chosen), colors["reset"])
+		printBackupTable(backups)
+		return
 	}
-	tbl.Print()
+	fmt.Printf("%sFollowing %d backup file(s) will be deleted%s\n\n", colors["red"], len(chosen), colors["reset"])
+	printBackupTable(backups)
 	fmt.Printf("\n")
 	// Show a yes/no prompt
-	ok := yesNoPrompt("Do you want to delete?", false)
-	if ok == true {
-		for i := 0; i < toDelete; i++ {
-			e = os.Remove(dir + backups[i].Name)
-			if e == nil {
-				fmt.Printf("%sFile %s has been deleted successfully%s\n", colors["green"], backups[i].Name, colors["reset"])
-			} else {
-				fmt.Printf("%sFile %s could not be deleted. Check file permission or run as the super user.%s\n", colors["red"], backups[i].Name, colors["reset"])
-			}
+	if yes == false {
+		ok := yesNoPrompt("Do you want to delete?", false)
+		if ok == false {
+			return
 		}
 	}
+	failed := deleteBackups(chosen, loc.Store)
+	collectChunks(loc.Store)
+	if failed > 0 {
+		fmt.Printf("%s%d of %d backup file(s) could not be deleted%s\n", colors["red"], failed, len(chosen), colors["reset"])
+		os.Exit(deletePartial)
+	}
+	os.Exit(deleteDone)
 }
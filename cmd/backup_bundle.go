@@ -0,0 +1,561 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	backUpCmd.AddCommand(exportBackupCmd)
+	backUpCmd.AddCommand(importBackupCmd)
+	exportBackupCmd.Flags().StringP("dir", "d", "", "Enter the directory of the file, absolute directory not relative.")
+	exportBackupCmd.Flags().StringP("file", "f", "", "Enter the filename")
+	exportBackupCmd.Flags().Bool("all", false, "Export every backup of the backup store, or of the directory without a store.")
+	exportBackupCmd.Flags().StringP("output", "o", "", "Path of the bundle, e.g. backups.tar.zst.")
+	exportBackupCmd.MarkFlagRequired("output")
+	exportBackupCmd.MarkFlagsOneRequired("file", "all")
+	exportBackupCmd.MarkFlagsMutuallyExclusive("file", "all")
+	addStoreFlag(exportBackupCmd)
+	importBackupCmd.Flags().StringArray("remap", nil, "Import the backups of the files below /old as backups of the files below /new, e.g. /srv/old=/srv/new. Repeat the flag for several directories.")
+	importBackupCmd.Flags().BoolP("yes", "y", false, "Do not ask for confirmation.")
+	addStoreFlag(importBackupCmd)
+}
+
+var exportBackupCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Package backups with their metadata as a portable bundle.",
+	Long: `Package backups as a bundle, a zstd compressed tar archive, to carry them to another machine with bk import.
+The bundle keeps the backup files as they are, compressed or encrypted, with their metadata and their manifest
+records: time, checksums, note and tags. The chunks of deduplicated backups are included.`,
+	Run: export_backup,
+}
+
+var importBackupCmd = &cobra.Command{
+	Use:   "import <bundle>",
+	Short: "Import the backups of a bundle of bk export.",
+	Long: `Import the backups of a bundle of bk export. Every backup is verified against its checksum before anything is
+imported, then it is put next to its original file, or in the backup store, and added to the manifest. --remap
+imports the backups of the files of a directory as backups of another one. A backup that is already there is skipped.
+Without a store deduplicated backups are imported as zstd compressed backups.`,
+	Args: cobra.ExactArgs(1),
+	Run:  import_backup,
+}
+
+// A bundle is a zstd compressed tar archive. bundleIndexName comes first and lists
+// the backups, which are kept below bundleBackupDir in the tree of their original
+// files. Chunks are kept in a chunk directory like in a store.
+const (
+	bundleIndexName = "linate-bundle.json"
+	bundleBackupDir = "backups"
+)
+
+type bundleIndex struct {
+	Version int           `json:"version"`
+	Created time.Time     `json:"created"`
+	Host    string        `json:"host"`
+	Backups []bundleEntry `json:"backups"`
+}
+
+type bundleEntry struct {
+	// Path is the path of the backup in the bundle
+	Path string `json:"path"`
+	// FileChecksum is the sha256 of the backup file as it is on the disk, it is
+	// checked without the key of an encrypted backup
+	FileChecksum string         `json:"file_checksum"`
+	Record       manifestRecord `json:"record"`
+	file         string
+}
+
+// newBundleEntry returns the entry of a backup. A backup without a manifest record
+// gets one, like it was taken now.
+func newBundleEntry(b backupFile) (bundleEntry, error) {
+	var r manifestRecord
+	if b.Record != nil {
+		r = *b.Record
+	} else {
+		r = manifestRecord{Source: b.Dir + b.File, Time: b.takenAt(), ModTime: b.Info.ModTime()}
+		r.Size, _ = originalSize(b.Path(), b.Info)
+		if b.Encrypted == false || canDecrypt() {
+			sum, e := hashFile(b.Path(), b.encoding())
+			if e != nil {
+				return bundleEntry{}, e
+			}
+			r.Checksum = sum
+		}
+	}
+	sum, e := hashFile(b.Path(), "")
+	if e != nil {
+		return bundleEntry{}, e
+	}
+	if b.Encrypted && r.StoredChecksum == "" {
+		r.StoredChecksum = sum
+	}
+	r.Path = ""
+	return bundleEntry{
+		Path:         bundleBackupDir + filepath.Dir(r.Source) + "/" + b.Name,
+		FileChecksum: sum,
+		Record:       r,
+		file:         b.Path(),
+	}, nil
+}
+
+// addBundleFile writes the file at path to the bundle as name, with its metadata.
+func addBundleFile(tw *tar.Writer, path string, name string) error {
+	info, e := os.Lstat(path)
+	if e != nil {
+		return e
+	}
+	hdr, e := fileHeader(path, name, info)
+	if e != nil {
+		return e
+	}
+	if e = tw.WriteHeader(hdr); e != nil {
+		return e
+	}
+	f, e := os.Open(path)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	_, e = io.Copy(tw, f)
+	return e
+}
+
+// writeBundle writes the bundle of index to path and returns the sha256 of the tar
+// archive.
+func writeBundle(path string, index bundleIndex) (string, error) {
+	f, e := os.Create(path)
+	if e != nil {
+		return "", e
+	}
+	defer f.Close()
+	w, e := compressWriter(f, "zstd", -1)
+	if e != nil {
+		return "", e
+	}
+	h := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(w, h))
+
+	data, e := json.MarshalIndent(index, "", "  ")
+	if e != nil {
+		return "", e
+	}
+	hdr := &tar.Header{Name: bundleIndexName, Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(data)), ModTime: index.Created, Format: tar.FormatPAX}
+	if e = tw.WriteHeader(hdr); e != nil {
+		return "", e
+	}
+	if _, e = tw.Write(data); e != nil {
+		return "", e
+	}
+
+	chunks := map[string]bool{}
+	for _, entry := range index.Backups {
+		if e = addBundleFile(tw, entry.file, entry.Path); e != nil {
+			return "", e
+		}
+		if compressionOf(entry.file) != "dedup" {
+			continue
+		}
+		ref, e := readChunkRef(entry.file)
+		if e != nil {
+			return "", e
+		}
+		root, e := chunkRoot(entry.file)
+		if e != nil {
+			return "", e
+		}
+		for _, sum := range ref.Chunks {
+			if chunks[sum] {
+				continue
+			}
+			chunks[sum] = true
+			if e = addBundleFile(tw, chunkPath(root, sum), chunkDirName+"/"+sum[:2]+"/"+sum); e != nil {
+				return "", e
+			}
+		}
+	}
+
+	if e = tw.Close(); e != nil {
+		return "", e
+	}
+	if e = w.Close(); e != nil {
+		return "", e
+	}
+	if e = f.Sync(); e != nil {
+		return "", e
+	}
+	return hex.EncodeToString(h.Sum(nil)), f.Close()
+}
+
+func export_backup(cmd *cobra.Command, args []string) {
+	output, _ := cmd.Flags().GetString("output")
+	all, _ := cmd.Flags().GetBool("all")
+	loc := getBackupLocation(cmd)
+
+	var backups []backupFile
+	var e error
+	if all {
+		dir := loc.Dir
+		if loc.Store != nil {
+			dir = ""
+		}
+		groups, e := listBackupGroups(dir, loc.Store)
+		if e != nil {
+			exitWithError(fmt.Sprintf("Can not read the backups. %v\n", e))
+		}
+		for source, group := range groups {
+			if loc.Store == nil {
+				// The hidden manifest has the records of the backups next to the files
+				if group, e = locationOf(source, nil).list(); e != nil {
+					exitWithError(fmt.Sprintf("Can not read the backups of '%s'. %v\n", source, e))
+				}
+			}
+			backups = append(backups, group...)
+		}
+	} else {
+		backups, e = loc.list()
+		if e != nil {
+			exitWithError(fmt.Sprintf("Can not read the backups of '%s'. %v\n", loc.Source(), e))
+		}
+	}
+	if len(backups) == 0 {
+		fmt.Printf("No backup found\n")
+		return
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Path() < backups[j].Path()
+	})
+
+	index := bundleIndex{Version: 1, Created: time.Now().Truncate(time.Second)}
+	index.Host, _ = os.Hostname()
+	seen := map[string]bool{}
+	for _, b := range backups {
+		entry, e := newBundleEntry(b)
+		if e != nil {
+			exitWithError(fmt.Sprintf("Can not read the backup file '%s'. %v\n", b.Path(), e))
+		}
+		if seen[entry.Path] {
+			fmt.Printf("%sThe backup '%s' has the same name as another backup of '%s', it is left out.%s\n", colors["yellow"], b.Path(), entry.Record.Source, colors["reset"])
+			continue
+		}
+		seen[entry.Path] = true
+		index.Backups = append(index.Backups, entry)
+	}
+
+	output, _ = filepath.Abs(output)
+	_, _, e = atomicWrite(output, "zstd", "", func(tmp string) (string, error) {
+		return writeBundle(tmp, index)
+	})
+	if e != nil {
+		exitWithError(fmt.Sprintf("%sCan not write the bundle '%s'. %v%s\n", colors["red"], output, e, colors["reset"]))
+	}
+	size := int64(0)
+	if info, e := os.Stat(output); e == nil {
+		size = info.Size()
+	}
+	fmt.Printf("%slinate successfully exported %d backup(s) to '%s' (%s)%s\n", colors["green"], len(index.Backups), output, formatSize(size), colors["reset"])
+}
+
+// extractBundle extracts a bundle to dest and returns its index and the headers of
+// its files by name.
+func extractBundle(path string, dest string) (bundleIndex, map[string]*tar.Header, error) {
+	var index bundleIndex
+	headers := map[string]*tar.Header{}
+	f, e := os.Open(path)
+	if e != nil {
+		return index, nil, e
+	}
+	defer f.Close()
+	r, e := decompressReader(f, "zstd")
+	if e != nil {
+		return index, nil, e
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+
+	hdr, e := tr.Next()
+	if e != nil || hdr.Name != bundleIndexName {
+		return index, nil, errors.New("it is not a bundle of bk export")
+	}
+	data, e := io.ReadAll(tr)
+	if e != nil {
+		return index, nil, e
+	}
+	if e = json.Unmarshal(data, &index); e != nil {
+		return index, nil, fmt.Errorf("invalid %s: %v", bundleIndexName, e)
+	}
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return index, nil, e
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		target, e := memberPath(dest, hdr.Name)
+		if e != nil {
+			return index, nil, e
+		}
+		if e = os.MkdirAll(filepath.Dir(target), 0700); e != nil {
+			return index, nil, e
+		}
+		if e = writeMember(tr, target); e != nil {
+			return index, nil, e
+		}
+		headers[hdr.Name] = hdr
+	}
+	return index, headers, nil
+}
+
+// verifyBundleEntry checks an extracted backup against its checksums.
+func verifyBundleEntry(staging string, entry bundleEntry) error {
+	path, e := memberPath(staging, entry.Path)
+	if e != nil {
+		return e
+	}
+	sum, e := hashFile(path, "")
+	if e != nil {
+		return e
+	}
+	if sum != entry.FileChecksum {
+		return fmt.Errorf("sha256 %s, was %s", sum, entry.FileChecksum)
+	}
+	// The reference file is fine, its chunks must be as well
+	if compressionOf(path) == "dedup" {
+		sum, e = hashFile(path, "dedup")
+		if e != nil {
+			return e
+		}
+		if sum != entry.Record.Checksum {
+			return fmt.Errorf("content sha256 %s, was %s", sum, entry.Record.Checksum)
+		}
+	}
+	return nil
+}
+
+type pathRemap struct {
+	Old string
+	New string
+}
+
+// remapPath moves path from the old directory of the first remap that contains it
+// to the new one.
+func remapPath(path string, remaps []pathRemap) string {
+	for _, r := range remaps {
+		rel, e := filepath.Rel(r.Old, path)
+		if e == nil && rel != ".." && strings.HasPrefix(rel, "../") == false {
+			return filepath.Join(r.New, rel)
+		}
+	}
+	return path
+}
+
+// importEntry puts an extracted backup of the original file source in place and
+// records it. It returns the path of the backup, false when it was there already,
+// and the metadata that could not be kept.
+func importEntry(staging string, entry bundleEntry, hdr *tar.Header, source string, store *backupStore) (string, bool, []string, error) {
+	staged, e := memberPath(staging, entry.Path)
+	if e != nil {
+		return "", false, nil, e
+	}
+	b, ok := parseBackupName(filepath.Base(staged))
+	if ok == false {
+		return "", false, nil, fmt.Errorf("'%s' is not a backup name", filepath.Base(staged))
+	}
+	loc := locationOf(source, store)
+	dir := loc.BackupDir()
+	perm := os.FileMode(0755)
+	if store != nil {
+		perm = 0700
+	}
+	if e = os.MkdirAll(dir, perm); e != nil {
+		return "", false, nil, e
+	}
+	// A backup taken meanwhile could get the same name
+	lock, e := lockDir(loc.index().Root, -1)
+	if e != nil {
+		return "", false, nil, e
+	}
+	defer lock.unlock()
+	// Without a store there are no chunks
+	expand := b.Compression == "dedup" && store == nil
+	if expand {
+		b.Compression = "zstd"
+	}
+
+	if fileExists(dir + b.String()) {
+		sum, e := hashFile(dir+b.String(), "")
+		if expand {
+			sum, e = hashFile(dir+b.String(), "zstd")
+		}
+		if e == nil && (sum == entry.FileChecksum || expand && sum == entry.Record.Checksum) {
+			return dir + b.String(), false, nil, nil
+		}
+	}
+	recorded, e := loc.index().recordedPaths()
+	if e != nil {
+		return "", false, nil, e
+	}
+	for backupNameTaken(dir, b, recorded) {
+		b.Serial += 1
+	}
+	dst := dir + b.String()
+
+	switch {
+	case expand:
+		_, _, e = atomicWrite(dst, "zstd", "", func(tmp string) (string, error) {
+			return copyFile(staged, tmp, "dedup", "zstd")
+		})
+	case b.Compression == "dedup":
+		ref, e := readChunkRef(staged)
+		if e != nil {
+			return "", false, nil, e
+		}
+		for _, sum := range ref.Chunks {
+			target := chunkPath(store.Root, sum)
+			if fileExists(target) {
+				continue
+			}
+			if e = os.MkdirAll(filepath.Dir(target), 0700); e != nil {
+				return "", false, nil, e
+			}
+			_, _, e = atomicWrite(target, "", "", func(tmp string) (string, error) {
+				return copyFile(chunkPath(staging, sum), tmp, "", "")
+			})
+			if e != nil {
+				return "", false, nil, e
+			}
+		}
+		fallthrough
+	default:
+		_, _, e = atomicWrite(dst, "", "", func(tmp string) (string, error) {
+			return copyFile(staged, tmp, "", "")
+		})
+	}
+	if e != nil {
+		return "", false, nil, e
+	}
+	var lost []string
+	if hdr != nil {
+		lost = applyHeader(dst, hdr)
+	}
+
+	record := entry.Record
+	record.Source = source
+	if expand {
+		record.StoredChecksum = ""
+	}
+	if info, e := os.Stat(dst); e == nil {
+		record.ModTime = info.ModTime()
+	}
+	index := loc.index()
+	record.Path = index.relPath(dst)
+	if e = index.addRecord(record); e != nil {
+		os.Remove(dst)
+		return "", false, nil, e
+	}
+	return dst, true, lost, nil
+}
+
+func import_backup(cmd *cobra.Command, args []string) {
+	rawRemaps, _ := cmd.Flags().GetStringArray("remap")
+	yes, _ := cmd.Flags().GetBool("yes")
+	store := getStore(cmd)
+	var remaps []pathRemap
+	for _, raw := range rawRemaps {
+		old, new, ok := strings.Cut(raw, "=")
+		if ok == false || filepath.IsAbs(old) == false || filepath.IsAbs(new) == false {
+			exitWithError(fmt.Sprintf("Invalid remap '%s'. Please use absolute directories like /old=/new.\n", raw))
+		}
+		remaps = append(remaps, pathRemap{Old: filepath.Clean(old), New: filepath.Clean(new)})
+	}
+
+	staging, e := os.MkdirTemp("", "linate-import-")
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not create a temporary directory. %v\n", e))
+	}
+	stop := removeOnInterrupt(staging)
+	defer stop()
+	defer os.RemoveAll(staging)
+
+	index, headers, e := extractBundle(args[0], staging)
+	if e != nil {
+		os.RemoveAll(staging)
+		exitWithError(fmt.Sprintf("Can not read the bundle '%s'. %v\n", args[0], e))
+	}
+	failed := 0
+	for _, entry := range index.Backups {
+		if e = verifyBundleEntry(staging, entry); e != nil {
+			failed += 1
+			fmt.Printf("%sMODIFIED %s (%v)%s\n", colors["red"], entry.Path, e, colors["reset"])
+		}
+	}
+	if failed > 0 {
+		os.RemoveAll(staging)
+		exitWithError(fmt.Sprintf("%d backup(s) of the bundle are damaged, nothing has been imported.\n", failed))
+	}
+	if len(index.Backups) == 0 {
+		fmt.Printf("No backup found\n")
+		return
+	}
+
+	fmt.Printf("%sFollowing %d backup file(s) of %s, exported on %s, will be imported%s\n\n", colors["yellow"], len(index.Backups), index.Host, index.Created.Local().Format("2006-01-02 15:04"), colors["reset"])
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+	tbl := table.New("File", "Backup", "Size")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	for _, entry := range index.Backups {
+		tbl.AddRow(remapPath(entry.Record.Source, remaps), filepath.Base(entry.Path), fmt.Sprintf("%v byte", entry.Record.Size))
+	}
+	tbl.Print()
+	fmt.Printf("\n")
+	if yes == false {
+		ok := yesNoPrompt("Do you want to import?", false)
+		if ok == false {
+			return
+		}
+	}
+
+	imported, present := 0, 0
+	var lost []string
+	for _, entry := range index.Backups {
+		source := remapPath(entry.Record.Source, remaps)
+		path, added, l, e := importEntry(staging, entry, headers[entry.Path], source, store)
+		if e != nil {
+			failed += 1
+			fmt.Printf("%sThe backup %s of '%s' could not be imported. %v%s\n", colors["red"], filepath.Base(entry.Path), source, e, colors["reset"])
+			continue
+		}
+		if added == false {
+			present += 1
+			fmt.Printf("File %s is already there\n", path)
+			continue
+		}
+		imported += 1
+		lost = append(lost, l...)
+		fmt.Printf("%sFile %s has been imported%s\n", colors["green"], path, colors["reset"])
+	}
+	printLostMetadata(lost)
+	fmt.Printf("\n%d imported, %d already there, %d failed\n", imported, present, failed)
+	if failed > 0 {
+		os.RemoveAll(staging)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	backUpCmd.AddCommand(conffilesBackupCmd)
+	addStoreFlag(conffilesBackupCmd)
+}
+
+var conffilesBackupCmd = &cobra.Command{
+	Use:   "conffiles",
+	Short: "Show the package config files changed locally.",
+	Long: `Show the config files of dpkg and rpm packages that differ from the version the package shipped, with their
+backups. dpkg files are compared with the md5sums of the dpkg database, rpm files are verified with rpm -V. Files
+removed locally are shown as missing. bk take --modified-conffiles backs up every modified file.`,
+	Run: conffiles_backup,
+}
+
+func conffiles_backup(cmd *cobra.Command, args []string) {
+	store := getStore(cmd)
+	files, e := modifiedConffiles()
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the package database. %v\n", e))
+	}
+	if len(files) == 0 {
+		fmt.Printf("No modified conffile found\n")
+		return
+	}
+
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+	tbl := table.New("File", "Package", "State", "Backups", "Newest Backup")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	unreadable := 0
+	for _, f := range files {
+		if f.State == conffileUnreadable {
+			unreadable += 1
+		}
+		newest := "-"
+		backups, _ := locationOf(f.Path, store).list()
+		if len(backups) > 0 {
+			tm := backups[0].takenAt()
+			newest = fmt.Sprintf("%v-%v-%v | %v:%v", tm.Year(), tm.Month(), tm.Day(), tm.Hour(), tm.Minute())
+		}
+		tbl.AddRow(f.Path, f.Package, f.State, len(backups), newest)
+	}
+	tbl.Print()
+	fmt.Printf("\nTotal:%s %d conffile(s)%s\n", colors["yellow"], len(files), colors["reset"])
+	if unreadable > 0 {
+		fmt.Printf("%s%d conffile(s) could not be read. Please run as the superuser to compare them.%s\n", colors["yellow"], unreadable, colors["reset"])
+	}
+}
+
+// backedUp reports whether the newest backup of the file at loc has its current
+// content.
+func backedUp(loc backupLocation) bool {
+	backups, e := loc.list()
+	if e != nil || len(backups) == 0 || backups[0].Record == nil {
+		return false
+	}
+	sum, e := hashFile(loc.Source(), "")
+	return e == nil && backups[0].Record.Checksum == sum
+}
+
+// takeConffiles backs up every modified conffile with one time. Files whose newest
+// backup has their current content are skipped, so it can run from cron. The
+// backups get a note naming the package unless opts has one. A store is required:
+// drop-in directories like /etc/cron.d or /etc/sudoers.d load every file whose name
+// has no dot, a backup next to the conffile would be loaded as config.
+func takeConffiles(opts backupOptions, store *backupStore) {
+	if store == nil {
+		exitWithError(fmt.Sprintf("%sbk take --modified-conffiles needs a backup store, backups next to conffiles in directories like /etc/cron.d would be loaded as config. Please use the --store flag or set backup.store in the config file.%s\n", colors["red"], colors["reset"]))
+	}
+	files, e := modifiedConffiles()
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the package database. %v\n", e))
+	}
+	opts.Time = time.Now()
+
+	var taken []string
+	var lost []string
+	unchanged := 0
+	failed := 0
+	for _, f := range files {
+		if f.State == conffileMissing {
+			continue
+		}
+		if f.State == conffileUnreadable {
+			fmt.Printf("%sConffile '%s' can not be read. Please run as the superuser to back it up.%s\n", colors["yellow"], f.Path, colors["reset"])
+			failed += 1
+			continue
+		}
+		loc := locationOf(f.Path, store)
+		if backedUp(loc) {
+			unchanged += 1
+			continue
+		}
+		o := opts
+		if o.Note == "" {
+			o.Note = fmt.Sprintf("modified conffile of %s", f.Package)
+		}
+		backup, l, e := createBackup(loc, o)
+		exitOnHookError(e, "The remaining conffiles have not been backed up.")
+		exitOnLockError(e, "The remaining conffiles have not been backed up.")
+		if e != nil {
+			fmt.Printf("%sCan not create the backup of '%s'. %v%s\n", colors["red"], f.Path, e, colors["reset"])
+			failed += 1
+			continue
+		}
+		taken = append(taken, backup)
+		lost = append(lost, l...)
+	}
+
+	if len(taken) > 0 {
+		fmt.Printf("%slinate successfully created %d backup file(s) of modified conffiles%s\n", colors["green"], len(taken), colors["reset"])
+		for _, b := range taken {
+			fmt.Printf("  %s\n", b)
+		}
+	}
+	if unchanged > 0 {
+		fmt.Printf("%d modified conffile(s) have not changed since their last backup\n", unchanged)
+	}
+	if len(taken) == 0 && unchanged == 0 && failed == 0 {
+		fmt.Printf("No modified conffile found\n")
+	}
+	printLostMetadata(lost)
+	if failed > 0 {
+		exitWithError(fmt.Sprintf("%d conffile(s) have not been backed up.\n", failed))
+	}
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// setupConffile returns a dpkg status file listing a modified conffile in a drop-in
+// directory, and the directory.
+func setupConffile(t *testing.T) string {
+	t.Helper()
+	loadedConfig = &linateConfig{}
+	dir := t.TempDir()
+	dropIn := filepath.Join(dir, "cron.d")
+	if e := os.Mkdir(dropIn, 0755); e != nil {
+		t.Fatal(e)
+	}
+	conffile := filepath.Join(dropIn, "logrotate")
+	if e := os.WriteFile(conffile, []byte("0 3 * * * root /usr/sbin/logrotate\n"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	status := filepath.Join(dir, "status")
+	content := fmt.Sprintf("Package: logrotate\nStatus: install ok installed\nConffiles:\n %s 00000000000000000000000000000000\n\n", conffile)
+	if e := os.WriteFile(status, []byte(content), 0644); e != nil {
+		t.Fatal(e)
+	}
+	dpkgStatusPath = status
+	return dropIn
+}
+
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, e := os.ReadDir(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestTakeConffilesStore(t *testing.T) {
+	if os.Getenv("LINATE_TEST_CONFFILES") != "" {
+		// Run by TestTakeConffilesNoStore, takeConffiles exits
+		dpkgStatusPath = os.Getenv("LINATE_TEST_CONFFILES")
+		loadedConfig = &linateConfig{}
+		takeConffiles(backupOptions{}, nil)
+		return
+	}
+	status := dpkgStatusPath
+	defer func() { dpkgStatusPath = status }()
+	dropIn := setupConffile(t)
+	store := &backupStore{Root: t.TempDir()}
+
+	takeConffiles(backupOptions{}, store)
+	if names := dirNames(t, dropIn); len(names) != 1 {
+		t.Errorf("the drop-in directory has %v, want only the conffile", names)
+	}
+	backups, e := locationOf(filepath.Join(dropIn, "logrotate"), store).list()
+	if e != nil || len(backups) != 1 {
+		t.Fatalf("the store has %d backups, want 1: %v", len(backups), e)
+	}
+	if backups[0].Record == nil || backups[0].Record.Note != "modified conffile of logrotate" {
+		t.Errorf("the backup has no note of its package")
+	}
+}
+
+func TestTakeConffilesNoStore(t *testing.T) {
+	status := dpkgStatusPath
+	defer func() { dpkgStatusPath = status }()
+	dropIn := setupConffile(t)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestTakeConffilesStore$")
+	cmd.Env = append(os.Environ(), "LINATE_TEST_CONFFILES="+dpkgStatusPath)
+	if out, e := cmd.CombinedOutput(); e == nil {
+		t.Errorf("bk take --modified-conffiles without a store succeeded:\n%s", out)
+	}
+	if names := dirNames(t, dropIn); len(names) != 1 {
+		t.Errorf("the drop-in directory has %v, want only the conffile", names)
+	}
+}
@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	backUpCmd.AddCommand(diffBackupCmd)
+	diffBackupCmd.Flags().StringP("dir", "d", "", "Enter the directory of the file, absolute directory not relative.")
+	diffBackupCmd.Flags().StringP("file", "f", "", "Enter the filename")
+	diffBackupCmd.Flags().StringP("backup", "b", "", "Name of the backup file. Default is the newest backup.")
+	diffBackupCmd.Flags().StringP("against", "a", "", "Name of another backup file to compare with. Default is the current file.")
+	diffBackupCmd.Flags().StringP("member", "m", "", "Only compare this file of a directory backup, relative to the directory.")
+	diffBackupCmd.MarkFlagRequired("file")
+	addStoreFlag(diffBackupCmd)
+}
+
+var diffBackupCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Show the difference between a file and its backup.",
+	Long: `Show the difference between a file and its backup as a unified diff. By default the newest backup
+is compared with the current file. A directory backup is compared file by file with the current directory.
+Exit status is 0 if the files are the same, 1 if they differ and 2 on error.`,
+	Run: diff_backup,
+}
+
+// Exit codes of bk diff, the same as diff(1)
+const (
+	diffSame    = 0
+	diffDiffers = 1
+	diffTrouble = 2
+)
+
+func diff_backup(cmd *cobra.Command, args []string) {
+	backupName, _ := cmd.Flags().GetString("backup")
+	against, _ := cmd.Flags().GetString("against")
+	member, _ := cmd.Flags().GetString("member")
+	dir, _ := cmd.Flags().GetString("dir")
+	if dir != "" && dirExists(dir) == false {
+		exitWithErrorCode(fmt.Sprintf("Directory '%s' does not exist or follows a strict permission. Please run as the superuser if the directory really exists.\n", dir), diffTrouble)
+	}
+	loc := getBackupLocation(cmd)
+
+	fromPath := loc.BackupDir() + backupName
+	if backupName == "" {
+		backups, e := loc.list()
+		if e != nil {
+			exitWithErrorCode(fmt.Sprintf("Can not read the backups of '%s'. %v\n", loc.Source(), e), diffTrouble)
+		}
+		if len(backups) == 0 {
+			exitWithErrorCode("No backup found\n", diffTrouble)
+		}
+		fromPath = backups[0].Path()
+		backupName = backups[0].Name
+	}
+	toName := loc.File
+	toPath := loc.Source()
+	if against != "" {
+		toName = against
+		toPath = loc.BackupDir() + against
+	}
+
+	if b, _ := parseBackupName(filepath.Base(fromPath)); b.Archive {
+		os.Exit(diffArchive(backupName, fromPath, toName, toPath, against != "", member))
+	}
+	if member != "" {
+		exitWithErrorCode("The --member flag only works with the backup of a directory.\n", diffTrouble)
+	}
+
+	from, e := readBackup(fromPath)
+	if e != nil {
+		exitWithErrorCode(fmt.Sprintf("Can not read the file '%s'. %v\n", fromPath, e), diffTrouble)
+	}
+	var to []byte
+	if against != "" {
+		to, e = readBackup(toPath)
+	} else {
+		to, e = os.ReadFile(toPath)
+	}
+	if e != nil {
+		exitWithErrorCode(fmt.Sprintf("Can not read the file '%s'. %v\n", toPath, e), diffTrouble)
+	}
+
+	if bytes.Equal(from, to) {
+		fmt.Printf("%s'%s' and '%s' are identical%s\n", colors["green"], backupName, toName, colors["reset"])
+		os.Exit(diffSame)
+	}
+	printContentDiff(backupName, toName, from, to)
+	os.Exit(diffDiffers)
+}
+
+// diffArchive compares a directory backup with the directory at toPath, or with
+// another directory backup, and returns the exit code of bk diff.
+func diffArchive(fromName string, fromPath string, toName string, toPath string, toArchive bool, member string) int {
+	r, e := openBackup(fromPath)
+	if e != nil {
+		exitWithErrorCode(fmt.Sprintf("Can not read the file '%s'. %v\n", fromPath, e), diffTrouble)
+	}
+	from, e := readArchiveFiles(r)
+	r.Close()
+	if e != nil {
+		exitWithErrorCode(fmt.Sprintf("Can not read the archive '%s'. %v\n", fromPath, e), diffTrouble)
+	}
+	var to map[string][]byte
+	if toArchive {
+		r, e = openBackup(toPath)
+		if e == nil {
+			to, e = readArchiveFiles(r)
+			r.Close()
+		}
+	} else {
+		to, e = readTreeFiles(toPath)
+	}
+	if e != nil {
+		exitWithErrorCode(fmt.Sprintf("Can not read '%s'. %v\n", toPath, e), diffTrouble)
+	}
+
+	if member != "" {
+		var ok bool
+		from, to, ok = selectMember(from, to, member)
+		if ok == false {
+			exitWithErrorCode(fmt.Sprintf("No such member '%s' in '%s' or '%s'\n", member, fromName, toName), diffTrouble)
+		}
+	}
+	if diffFileSets(fromName, toName, from, to) == false {
+		fmt.Printf("%s'%s' and '%s' are identical%s\n", colors["green"], fromName, toName, colors["reset"])
+		return diffSame
+	}
+	return diffDiffers
+}
+
+// selectMember returns the member of both sets of files, false when neither has it,
+// e.g. for a typo in --member.
+func selectMember(from map[string][]byte, to map[string][]byte, member string) (map[string][]byte, map[string][]byte, bool) {
+	member = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(member)), "/")
+	_, inFrom := from[member]
+	_, inTo := to[member]
+	if inFrom == false && inTo == false {
+		return nil, nil, false
+	}
+	return map[string][]byte{member: from[member]}, map[string][]byte{member: to[member]}, true
+}
+
+// diffFileSets prints the differences between two sets of files by name, like
+// diff -r, and reports whether there are any. A nil content is a missing file.
+func diffFileSets(fromName string, toName string, from map[string][]byte, to map[string][]byte) bool {
+	var names []string
+	for name := range from {
+		names = append(names, name)
+	}
+	for name := range to {
+		if _, ok := from[name]; ok == false {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	differs := false
+	for _, name := range names {
+		a, b := from[name], to[name]
+		switch {
+		case a == nil && b == nil:
+			continue
+		case b == nil:
+			fmt.Printf("%sOnly in %s: %s%s\n", colors["red"], fromName, name, colors["reset"])
+		case a == nil:
+			fmt.Printf("%sOnly in %s: %s%s\n", colors["green"], toName, name, colors["reset"])
+		case bytes.Equal(a, b):
+			continue
+		default:
+			printContentDiff(fromName+"/"+name, toName+"/"+name, a, b)
+		}
+		differs = true
+	}
+	return differs
+}
+
+// printContentDiff prints a unified diff of two different contents, or their size
+// and checksum when one of them is binary.
+func printContentDiff(aName string, bName string, a []byte, b []byte) {
+	if isBinary(a) || isBinary(b) {
+		fmt.Printf("Binary files '%s' and '%s' differ\n", aName, bName)
+		fmt.Printf("%-40s %12d byte  sha256 %x\n", aName, len(a), sha256.Sum256(a))
+		fmt.Printf("%-40s %12d byte  sha256 %x\n", bName, len(b), sha256.Sum256(b))
+		return
+	}
+	printUnifiedDiff(aName, bName, string(a), string(b))
+}
+
+// isBinary reports whether data looks like a binary file. Like git, it looks for a
+// NUL byte in the first 8000 bytes.
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) != -1
+}
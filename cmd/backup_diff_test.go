@@ -0,0 +1,17 @@
+package cmd
+
+import "testing"
+
+func TestSelectMember(t *testing.T) {
+	from := map[string][]byte{"etc/nginx.conf": []byte("a"), "etc/old.conf": []byte("b")}
+	to := map[string][]byte{"etc/nginx.conf": []byte("c"), "etc/new.conf": []byte("d")}
+	for _, member := range []string{"etc/nginx.conf", "/etc/old.conf", "./etc/new.conf"} {
+		f, tt, ok := selectMember(from, to, member)
+		if ok == false || len(f) != 1 || len(tt) != 1 {
+			t.Errorf("selectMember(%q) = %v, %v, %v", member, f, tt, ok)
+		}
+	}
+	if _, _, ok := selectMember(from, to, "etc/ngnix.conf"); ok {
+		t.Error("selectMember accepts a member in neither archive")
+	}
+}
@@ -0,0 +1,270 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	backUpCmd.AddCommand(findBackupCmd)
+	findBackupCmd.Flags().String("root", "/", "Directory to search.")
+	findBackupCmd.Flags().String("min-age", "", "Only count backups older than this, e.g. 12h, 30d or 2w.")
+	findBackupCmd.Flags().String("min-size", "", "Only count backups of at least this size, e.g. 10M.")
+	findBackupCmd.Flags().BoolP("one-file-system", "x", false, "Do not search other file systems mounted below the root.")
+}
+
+var findBackupCmd = &cobra.Command{
+	Use:   "find",
+	Short: "Find the backups in a directory tree.",
+	Long: `Find every linate backup below a directory, / by default, and show how many backups each file has and
+how much space they take. Directories are searched in parallel, /proc and /sys are skipped and symlinks are not
+followed. Backups in a backup store are shown under the path of their original file.`,
+	Run: find_backup,
+}
+
+// skippedDirs are never searched, they hold no backups and reading them is slow or
+// has side effects.
+var skippedDirs = []string{"/proc", "/sys"}
+
+// backupFinder walks a directory tree in parallel and collects the backups in it.
+type backupFinder struct {
+	// sem limits the directories read at the same time, a directory is read by the
+	// goroutine that found it when every slot is taken
+	sem   chan struct{}
+	wg    sync.WaitGroup
+	dev   uint64
+	oneFS bool
+
+	mu         sync.Mutex
+	backups    []backupFile
+	stores     []string
+	unreadable int
+}
+
+func deviceOf(info fs.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev)
+	}
+	return 0
+}
+
+// walk reads dir and the directories below it.
+func (f *backupFinder) walk(dir string) {
+	entries, e := os.ReadDir(dir)
+	if e != nil {
+		f.mu.Lock()
+		f.unreadable += 1
+		f.mu.Unlock()
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if entry.Name() == chunkDirName || entry.Name() == historyDirName || arrContains(skippedDirs, path) {
+				continue
+			}
+			if f.oneFS {
+				info, e := entry.Info()
+				if e != nil || deviceOf(info) != f.dev {
+					continue
+				}
+			}
+			select {
+			case f.sem <- struct{}{}:
+				f.wg.Add(1)
+				go func() {
+					defer f.wg.Done()
+					f.walk(path)
+					<-f.sem
+				}()
+			default:
+				f.walk(path)
+			}
+			continue
+		}
+		if entry.Type().IsRegular() == false || strings.Contains(entry.Name(), ".linate-tmp-") {
+			continue
+		}
+		if entry.Name() == manifestName {
+			f.mu.Lock()
+			f.stores = append(f.stores, dir)
+			f.mu.Unlock()
+			continue
+		}
+		b, ok := parseBackupName(entry.Name())
+		if ok == false {
+			continue
+		}
+		info, e := entry.Info()
+		if e != nil {
+			continue
+		}
+		f.mu.Lock()
+		f.backups = append(f.backups, backupFile{backupName: b, Dir: dir + "/", Name: entry.Name(), Info: info})
+		f.mu.Unlock()
+	}
+}
+
+// findBackupsIn returns every backup below root, the backup stores found and how many
+// directories could not be read.
+func findBackupsIn(root string, oneFS bool) ([]backupFile, []*backupStore, int, error) {
+	info, e := os.Stat(root)
+	if e != nil {
+		return nil, nil, 0, e
+	}
+	f := &backupFinder{sem: make(chan struct{}, 4*runtime.NumCPU()), dev: deviceOf(info), oneFS: oneFS}
+	f.walk(filepath.Clean(root))
+	f.wg.Wait()
+
+	// Only a manifest of linate makes a store, manifest.json is a common name
+	var stores []*backupStore
+	for _, dir := range f.stores {
+		s := &backupStore{Root: dir}
+		if m, e := s.loadManifest(); e == nil && m.Version > 0 && len(m.Backups) > 0 {
+			stores = append(stores, s)
+		}
+	}
+	return f.backups, stores, f.unreadable, nil
+}
+
+// sourceOf returns the original file of a backup found by bk find. The manifest of
+// the store tells it for a backup in a store, otherwise it is next to the backup.
+func sourceOf(b backupFile, sources map[string]string) string {
+	if source, ok := sources[b.Path()]; ok {
+		return source
+	}
+	return b.Dir + b.File
+}
+
+func find_backup(cmd *cobra.Command, args []string) {
+	root, _ := cmd.Flags().GetString("root")
+	rawAge, _ := cmd.Flags().GetString("min-age")
+	rawSize, _ := cmd.Flags().GetString("min-size")
+	oneFS, _ := cmd.Flags().GetBool("one-file-system")
+	var minAge time.Duration
+	var minSize int64
+	var e error
+	if rawAge != "" {
+		minAge, e = parseAge(rawAge)
+		if e != nil {
+			exitWithError(fmt.Sprintf("Invalid age '%s'. Please use an age like 12h, 30d or 2w.\n", rawAge))
+		}
+	}
+	if rawSize != "" {
+		minSize, e = parseSize(rawSize)
+		if e != nil {
+			exitWithError(fmt.Sprintf("Invalid size '%s'. Please use a size like 500K, 10M or 1G.\n", rawSize))
+		}
+	}
+	root, _ = filepath.Abs(root)
+	if dirExists(root) == false {
+		exitWithError(fmt.Sprintf("Directory '%s' does not exist or follows a strict permission. Please run as the superuser if the directory really exists.\n", root))
+	}
+
+	backups, stores, unreadable, e := findBackupsIn(root, oneFS)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not search '%s'. %v\n", root, e))
+	}
+	sources := map[string]string{}
+	for _, s := range stores {
+		m, _ := s.loadManifest()
+		for _, r := range m.Backups {
+			sources[filepath.Join(s.Root, r.Path)] = r.Source
+		}
+	}
+
+	type group struct {
+		source string
+		count  int
+		size   int64
+		newest time.Time
+	}
+	groups := map[string]*group{}
+	now := time.Now()
+	for _, b := range backups {
+		if rawAge != "" && now.Sub(b.takenAt()) <= minAge {
+			continue
+		}
+		if b.Info.Size() < minSize {
+			continue
+		}
+		source := sourceOf(b, sources)
+		g := groups[source]
+		if g == nil {
+			g = &group{source: source}
+			groups[source] = g
+		}
+		g.count += 1
+		g.size += b.Info.Size()
+		if b.takenAt().After(g.newest) {
+			g.newest = b.takenAt()
+		}
+	}
+
+	if unreadable > 0 {
+		fmt.Printf("%s%d directories could not be read. Please run as the superuser to search them.%s\n", colors["yellow"], unreadable, colors["reset"])
+	}
+	if len(groups) == 0 {
+		fmt.Printf("No backup found\n")
+		return
+	}
+	var sorted []*group
+	var count int
+	var total int64
+	for _, g := range groups {
+		sorted = append(sorted, g)
+		count += g.count
+		total += g.size
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].source < sorted[j].source
+	})
+
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+	tbl := table.New("File", "Backups", "Total Size", "Newest Backup")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	for _, g := range sorted {
+		tm := g.newest
+		tbl.AddRow(g.source, g.count, formatSize(g.size), fmt.Sprintf("%v-%v-%v | %v:%v", tm.Year(), tm.Month(), tm.Day(), tm.Hour(), tm.Minute()))
+	}
+	tbl.Print()
+	fmt.Printf("\nTotal:%s %d backup(s) of %d file(s), %s%s\n", colors["yellow"], count, len(sorted), formatSize(total), colors["reset"])
+
+	// The chunks of deduplicated backups take the space, not their .ref files
+	for _, s := range stores {
+		chunks, size := chunkDirUsage(s)
+		if chunks > 0 {
+			fmt.Printf("Chunks of the store %s:%s %d chunk(s), %s%s\n", strings.TrimSuffix(s.Root, "/"), colors["yellow"], chunks, formatSize(size), colors["reset"])
+		}
+	}
+}
+
+// chunkDirUsage returns how many chunks a store keeps and their size.
+func chunkDirUsage(s *backupStore) (int, int64) {
+	count := 0
+	var size int64
+	filepath.WalkDir(filepath.Join(s.Root, chunkDirName), func(path string, d fs.DirEntry, e error) error {
+		if e != nil || d.IsDir() {
+			return nil
+		}
+		if info, e := d.Info(); e == nil {
+			count += 1
+			size += info.Size()
+		}
+		return nil
+	})
+	return count, size
+}
@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	backUpCmd.AddCommand(historyBackupCmd)
+	historyBackupCmd.Flags().StringP("dir", "d", "", "Enter the directory of the file, absolute directory not relative.")
+	historyBackupCmd.Flags().StringP("file", "f", "", "Enter the filename")
+	historyBackupCmd.MarkFlagRequired("file")
+	addStoreFlag(historyBackupCmd)
+}
+
+var historyBackupCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show the history of a file.",
+	Long: `Show the revisions of a file taken with bk take --history, newest first, with their author, time, note and
+the number of added and deleted lines. The history is kept in a bare git repository, .linate-history, in the backup
+store or in the directory of the file. bk restore --rev restores a revision.`,
+	Run: history_backup,
+}
+
+func history_backup(cmd *cobra.Command, args []string) {
+	loc := getBackupLocation(cmd)
+	dir, path := loc.historyOf()
+	h, e := openHistory(dir, false)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not open the history '%s'. %v\n", dir, e))
+	}
+	var entries []historyEntry
+	if h != nil {
+		entries, e = h.log(path)
+		if e != nil {
+			exitWithError(fmt.Sprintf("Can not read the history of '%s'. %v\n", loc.Source(), e))
+		}
+	}
+	if len(entries) == 0 {
+		fmt.Printf("No revision found\n")
+		return
+	}
+	fmt.Printf("Total number of revisions:%s %d%s\n", colors["yellow"], len(entries), colors["reset"])
+
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+	tbl := table.New("Revision", "Date | Time", "Author", "Note", "Changes")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	for _, entry := range entries {
+		tm := entry.Time.Local()
+		note := entry.Note
+		if len(entry.Tags) > 0 {
+			note = strings.TrimSpace(note + " [" + strings.Join(entry.Tags, ", ") + "]")
+		}
+		tbl.AddRow(shortHash(entry.Hash), fmt.Sprintf("%v-%v-%v | %v:%v", tm.Year(), tm.Month(), tm.Day(), tm.Hour(), tm.Minute()), entry.Author, note, fmt.Sprintf("+%d -%d", entry.Added, entry.Deleted))
+	}
+	tbl.Print()
+}
+
+// useHistory reports whether bk take commits to the history instead of taking a
+// backup file, by --history or backup.history of the config file. Flags that only
+// make sense for backup files turn the default of the config file off.
+func useHistory(cmd *cobra.Command) bool {
+	if cmd.Flags().Changed("history") {
+		history, _ := cmd.Flags().GetBool("history")
+		return history
+	}
+	if getConfig().Backup.History == false {
+		return false
+	}
+	for _, flag := range []string{"recursive", "compress", "dedup", "encrypt", "target"} {
+		if cmd.Flags().Changed(flag) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileModeOf returns the git mode of the file at path.
+func fileModeOf(path string) (filemode.FileMode, error) {
+	info, e := os.Stat(path)
+	if e != nil {
+		return 0, e
+	}
+	if info.Mode()&0111 != 0 {
+		return filemode.Executable, nil
+	}
+	return filemode.Regular, nil
+}
+
+// commitHistory commits the current content of the file of loc to its history. It
+// returns the new revision, the zero hash when the history already has it.
+func commitHistory(loc backupLocation, note string, tags []string) (plumbing.Hash, error) {
+	dir, path := loc.historyOf()
+	h, e := openHistory(dir, true)
+	if e != nil {
+		return plumbing.ZeroHash, e
+	}
+	content, e := os.ReadFile(loc.Source())
+	if e != nil {
+		return plumbing.ZeroHash, e
+	}
+	mode, e := fileModeOf(loc.Source())
+	if e != nil {
+		return plumbing.ZeroHash, e
+	}
+	return h.commit(path, content, mode, historySignature(), historyMessage(note, tags))
+}
+
+// takeHistory commits the file of loc to its history, the history mode of bk take.
+func takeHistory(loc backupLocation, note string, tags []string) {
+	if e := checkSpace(loc, backupOptions{}); e != nil {
+		exitOnQuotaError(e, "The backup has not been taken.")
+		exitWithError(fmt.Sprintf("%sCan not check the free space for '%s'. %v%s\n", colors["red"], loc.Source(), e, colors["reset"]))
+	}
+	if e := runHooks(hookPreTake, hookEnv{Source: loc.Source(), Store: loc.Store}); e != nil {
+		exitOnHookError(e, "The backup has not been taken.")
+	}
+	hash, e := commitHistory(loc, note, tags)
+	if e != nil {
+		exitWithError(fmt.Sprintf("%sCan not commit '%s' to the history. Please run as the superuser if your user does not have permission to write to it. %v%s\n", colors["red"], loc.Source(), e, colors["reset"]))
+	}
+	dir, _ := loc.historyOf()
+	if hash.IsZero() {
+		fmt.Printf("%s'%s' has not changed since its last revision, nothing to commit%s\n", colors["green"], loc.Source(), colors["reset"])
+		return
+	}
+	fmt.Printf("%slinate successfully committed '%s' to the history as revision %s%s\n", colors["green"], loc.Source(), shortHash(hash), colors["reset"])
+	sum, _ := hashFile(loc.Source(), "")
+	runPostHooks(hookPostTake, hookEnv{Source: loc.Source(), Backup: dir, Checksum: sum, Store: loc.Store})
+}
+
+// restoreRevision replaces the file of loc with a revision of its history. The
+// current content is committed to the history first.
+func restoreRevision(loc backupLocation, rev string, yes bool) {
+	dir, path := loc.historyOf()
+	h, e := openHistory(dir, false)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not open the history '%s'. %v\n", dir, e))
+	}
+	if h == nil {
+		exitWithError(fmt.Sprintf("'%s' has no history. Please take a backup with bk take --history first.\n", loc.Source()))
+	}
+	c, e := h.resolve(rev)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Revision '%s' does not exist in the history '%s'.\n", rev, dir))
+	}
+	restored, mode, e := h.read(c, path)
+	if errors.Is(e, object.ErrFileNotFound) {
+		exitWithError(fmt.Sprintf("'%s' is not in the revision %s.\n", loc.Source(), shortHash(c.Hash)))
+	}
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the revision %s. %v\n", shortHash(c.Hash), e))
+	}
+
+	// Show what will change
+	current, e := os.ReadFile(loc.Source())
+	if e != nil && !os.IsNotExist(e) {
+		exitWithError(fmt.Sprintf("Can not read the file '%s'. Please run as the superuser if your user does not have permission to read it.\n", loc.Source()))
+	}
+	exists := e == nil
+	if exists && bytes.Equal(current, restored) {
+		fmt.Printf("%sThe file '%s' is identical to the revision %s. Nothing to restore.%s\n", colors["green"], loc.File, shortHash(c.Hash), colors["reset"])
+		return
+	}
+	printContentDiff(loc.File, shortHash(c.Hash), current, restored)
+	fmt.Printf("\n")
+
+	if yes == false {
+		ok := yesNoPrompt(fmt.Sprintf("Do you want to restore '%s' from the revision %s?", loc.File, shortHash(c.Hash)), false)
+		if ok == false {
+			return
+		}
+	}
+
+	// Keep the current content before replacing it
+	metaFrom := ""
+	if exists {
+		if e := checkSpace(loc, backupOptions{}); e != nil {
+			exitOnQuotaError(e, "Nothing has been restored.")
+			exitWithError(fmt.Sprintf("%sCan not check the free space for '%s'. %v%s\n", colors["red"], loc.Source(), e, colors["reset"]))
+		}
+		if e := runHooks(hookPreTake, hookEnv{Source: loc.Source(), Store: loc.Store}); e != nil {
+			exitOnHookError(e, "Nothing has been restored.")
+		}
+		safety, e := commitHistory(loc, "before restoring "+shortHash(c.Hash), nil)
+		if e != nil {
+			exitWithError(fmt.Sprintf("%sCan not commit the current file to the history, nothing has been restored. %v%s\n", colors["red"], e, colors["reset"]))
+		}
+		if safety.IsZero() == false {
+			fmt.Printf("%sThe current file has been saved as revision %s%s\n", colors["green"], shortHash(safety), colors["reset"])
+		}
+		metaFrom = loc.Source()
+	}
+
+	sum, lost, e := atomicWrite(loc.Source(), "", metaFrom, func(tmp string) (string, error) {
+		return copyReader(bytes.NewReader(restored), tmp, "", int64(len(restored)))
+	})
+	if e != nil {
+		exitWithError(fmt.Sprintf("%sCan not restore the file. %v%s\n", colors["red"], e, colors["reset"]))
+	}
+	if exists == false {
+		perm := os.FileMode(0644)
+		if mode == filemode.Executable {
+			perm = 0755
+		}
+		os.Chmod(loc.Source(), perm)
+	}
+	fmt.Printf("%slinate successfully restored '%s' from the revision %s%s\n", colors["green"], loc.File, shortHash(c.Hash), colors["reset"])
+	printLostMetadata(lost)
+	runPostHooks(hookPostRestore, hookEnv{Source: loc.Source(), Backup: dir, Checksum: sum, Store: loc.Store})
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	backUpCmd.AddCommand(migrateBackupCmd)
+	migrateBackupCmd.Flags().StringP("dir", "d", "", "Enter the directory of the file, absolute directory not relative.")
+	migrateBackupCmd.Flags().StringP("file", "f", "", "Enter the filename")
+	migrateBackupCmd.Flags().BoolP("yes", "y", false, "Do not ask for confirmation.")
+	migrateBackupCmd.MarkFlagRequired("file")
+	addStoreFlag(migrateBackupCmd)
+}
+
+var migrateBackupCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Rename old backup files to the current naming format.",
+	Long: `Rename backup files taken by linate 1.0, named <filename>-<year><month><day>-<serialnumber>,
+to <filename>-<yyyymmdd>T<hhmmss>-<serialnumber> so they sort by name. Old names are still recognized
+by every bk command, renaming them is optional.`,
+	Run: migrate_backup,
+}
+
+func migrate_backup(cmd *cobra.Command, args []string) {
+	loc := getBackupLocation(cmd)
+	yes, _ := cmd.Flags().GetBool("yes")
+	dir := loc.BackupDir()
+
+	backups, e := loc.list()
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the backups of '%s'. %v\n", loc.Source(), e))
+	}
+
+	// Pick the new names, oldest first so serial numbers keep their order
+	var oldNames, newNames []string
+	taken := map[string]bool{}
+	for i := len(backups) - 1; i >= 0; i-- {
+		if backups[i].Legacy == false {
+			continue
+		}
+		n := migratedName(backups[i])
+		for taken[n.String()] || fileExists(dir+n.String()) {
+			n.Serial += 1
+		}
+		taken[n.String()] = true
+		oldNames = append(oldNames, backups[i].Name)
+		newNames = append(newNames, n.String())
+	}
+	if len(oldNames) == 0 {
+		fmt.Printf("No backup in the old naming format found\n")
+		return
+	}
+
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+	tbl := table.New("File Name", "New Name")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	for i := range oldNames {
+		tbl.AddRow(oldNames[i], newNames[i])
+	}
+	tbl.Print()
+	fmt.Printf("\n")
+
+	if yes == false {
+		ok := yesNoPrompt("Do you want to rename?", false)
+		if ok == false {
+			return
+		}
+	}
+	// A backup taken meanwhile could get one of the new names
+	lock, e := lockDir(loc.index().Root, -1)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not lock the directory '%s'. %v\n", loc.index().Root, e))
+	}
+	defer lock.unlock()
+	for i := range oldNames {
+		if fileExists(dir + newNames[i]) {
+			fmt.Printf("%sFile %s has not been renamed, %s exists already. Please run bk migrate again.%s\n", colors["red"], oldNames[i], newNames[i], colors["reset"])
+			continue
+		}
+		e = os.Rename(dir+oldNames[i], dir+newNames[i])
+		if e != nil {
+			fmt.Printf("%sFile %s could not be renamed. Check file permission or run as the super user.%s\n", colors["red"], oldNames[i], colors["reset"])
+			continue
+		}
+		fmt.Printf("%sFile %s has been renamed to %s%s\n", colors["green"], oldNames[i], newNames[i], colors["reset"])
+		if e = loc.index().renameRecord(dir+oldNames[i], dir+newNames[i]); e != nil {
+			fmt.Printf("%sThe checksum of %s could not be updated, bk verify will report it as missing. %v%s\n", colors["yellow"], newNames[i], e, colors["reset"])
+		}
+	}
+}
+
+// migratedName returns the name of a backup in the linate 1.0 format in the current
+// format. Only the time changes, the suffixes stay so the backup can be restored.
+func migratedName(b backupFile) backupName {
+	n := b.backupName
+	n.Time = b.takenAt().Truncate(time.Second)
+	n.Legacy = false
+	return n
+}
@@ -0,0 +1,248 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backup files are named <file>-<yyyymmdd>T<hhmmss>-<serialnumber>, followed by .tar
+// for a directory and the compression extension if any. Backups taken by linate 1.0 are named
+// <file>-<year><month><day>-<serialnumber>, e.g. nginx.conf-2025May3-2, and are
+// still recognized.
+const backupTimeLayout = "20060102T150405"
+
+const archiveExt = ".tar"
+
+var (
+	backupTimePattern = regexp.MustCompile(`^\d{8}T\d{6}$`)
+	legacyDatePattern = regexp.MustCompile(`^\d{4}[A-Z][a-z]+\d{1,2}$`)
+	serialPattern     = regexp.MustCompile(`^[1-9]\d*$`)
+)
+
+// backupName is a parsed backup file name.
+type backupName struct {
+	File        string
+	Time        time.Time
+	Serial      int
+	Compression string
+	// Archive is set for a tar archive of a directory
+	Archive bool
+	// Encrypted is set for an age file, see encryptedExt
+	Encrypted bool
+	// Legacy is set for names in the linate 1.0 format, which have no time of day
+	Legacy bool
+}
+
+// String returns the file name of the backup.
+func (b backupName) String() string {
+	var stamp string
+	if b.Legacy {
+		stamp = fmt.Sprintf("%d%s%d", b.Time.Year(), b.Time.Month(), b.Time.Day())
+	} else {
+		stamp = b.Time.Format(backupTimeLayout)
+	}
+	ext := compressionExt[b.Compression]
+	if b.Archive {
+		ext = archiveExt + ext
+	}
+	if b.Encrypted {
+		ext += encryptedExt
+	}
+	return fmt.Sprintf("%s-%s-%d%s", b.File, stamp, b.Serial, ext)
+}
+
+// encoding returns how the content of the backup is compressed and encrypted.
+func (b backupName) encoding() string {
+	if b.Encrypted {
+		return b.Compression + encryptedSuffix
+	}
+	return b.Compression
+}
+
+// Before reports whether b was taken before o.
+func (b backupName) Before(o backupName) bool {
+	if b.Time.Equal(o.Time) {
+		return b.Serial < o.Serial
+	}
+	return b.Time.Before(o.Time)
+}
+
+// parseBackupName parses a backup file name. The name is read from the right, the
+// time and the serial number never contain a dash, so the original file name may.
+func parseBackupName(name string) (backupName, bool) {
+	var b backupName
+	rest, encrypted := strings.CutSuffix(name, encryptedExt)
+	b.Encrypted = encrypted
+	b.Compression = compressionOf(rest)
+	rest = strings.TrimSuffix(rest, compressionExt[b.Compression])
+	if strings.HasSuffix(rest, archiveExt) {
+		b.Archive = true
+		rest = strings.TrimSuffix(rest, archiveExt)
+	}
+
+	i := strings.LastIndex(rest, "-")
+	if i == -1 || !serialPattern.MatchString(rest[i+1:]) {
+		return b, false
+	}
+	b.Serial, _ = strconv.Atoi(rest[i+1:])
+	rest = rest[:i]
+
+	i = strings.LastIndex(rest, "-")
+	if i < 1 {
+		return b, false
+	}
+	stamp := rest[i+1:]
+	b.File = rest[:i]
+
+	var e error
+	switch {
+	case backupTimePattern.MatchString(stamp):
+		b.Time, e = time.ParseInLocation(backupTimeLayout, stamp, time.Local)
+	case legacyDatePattern.MatchString(stamp):
+		b.Time, e = time.ParseInLocation("2006January2", stamp, time.Local)
+		b.Legacy = true
+	default:
+		return b, false
+	}
+	if e != nil {
+		return b, false
+	}
+	return b, true
+}
+
+// newBackupName returns the name of a backup of file taken at t.
+func newBackupName(file string, t time.Time, serial int, compression string) backupName {
+	return backupName{
+		File:        file,
+		Time:        t.Truncate(time.Second),
+		Serial:      serial,
+		Compression: compression,
+	}
+}
+
+// backupFile is a backup of a file found in a directory.
+type backupFile struct {
+	backupName
+	// Dir is the directory of the backup, with a trailing slash
+	Dir  string
+	Name string
+	Info os.FileInfo
+	// Record is the manifest record of a backup in a store
+	Record *manifestRecord
+}
+
+func (b backupFile) Path() string {
+	return b.Dir + b.Name
+}
+
+// findBackups returns the backups of fileName in dir, newest first.
+func findBackups(dir string, fileName string) ([]backupFile, error) {
+	entries, e := os.ReadDir(dir)
+	if e != nil {
+		return nil, e
+	}
+	var backups []backupFile
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), fileName+"-") {
+			continue
+		}
+		b, ok := parseBackupName(entry.Name())
+		if ok == false || b.File != fileName {
+			continue
+		}
+		info, e := entry.Info()
+		if e != nil {
+			continue
+		}
+		backups = append(backups, backupFile{backupName: b, Dir: dir, Name: entry.Name(), Info: info})
+	}
+
+	sortBackups(backups)
+	return backups, nil
+}
+
+// sortBackups sorts backups newest first.
+func sortBackups(backups []backupFile) {
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[j].Before(backups[i].backupName)
+	})
+}
+
+// takenAt returns when a backup was taken. Legacy names have no time of day, but
+// linate 1.0 did not keep the modification time of the file, so it is the time of
+// the backup when it falls on the same day.
+func (b backupFile) takenAt() time.Time {
+	if b.Legacy && b.Info != nil {
+		mt := b.Info.ModTime()
+		y, m, d := mt.Date()
+		if y == b.Time.Year() && m == b.Time.Month() && d == b.Time.Day() {
+			return mt
+		}
+	}
+	return b.Time
+}
+
+// newFileInfo returns the table row of a backup.
+func newFileInfo(b backupFile) FileInfo {
+	var row FileInfo
+	tm := b.takenAt()
+	row.Name = b.Name
+	row.Size = fmt.Sprintf("%v byte", b.Info.Size())
+	row.OriginalSize = row.Size
+	if b.Encrypted {
+		// Decrypting every backup would need the key, the manifest knows the size
+		row.Encrypted = "yes"
+		row.OriginalSize = "-"
+		if b.Record != nil {
+			row.OriginalSize = fmt.Sprintf("%v byte", b.Record.Size)
+		}
+	} else if b.Compression != "" {
+		size, e := originalSize(b.Path(), b.Info)
+		if errors.Is(e, errSizeUnknown) && b.Record != nil && b.Record.Size > 0 {
+			size, e = b.Record.Size, nil
+		}
+		if e == nil {
+			row.OriginalSize = fmt.Sprintf("%v byte", size)
+		} else if errors.Is(e, errSizeUnknown) {
+			row.OriginalSize = "unknown"
+		} else {
+			row.OriginalSize = "ERROR"
+		}
+	}
+	row.ModTime = fmt.Sprintf("%v-%v-%v | %v:%v", tm.Year(), tm.Month(), tm.Day(), tm.Hour(), tm.Minute())
+	ow, e := getFileOwner(b.Path())
+	if e == nil {
+		row.Owner = ow
+	} else {
+		row.Owner = "ERROR"
+	}
+	if b.Record != nil {
+		row.Note = b.Record.Note
+		if len(b.Record.Tags) > 0 {
+			row.Note = strings.TrimSpace(row.Note + " [" + strings.Join(b.Record.Tags, ", ") + "]")
+		}
+	}
+	return row
+}
+
+// hasTag reports whether the backup was tagged with tag by bk take --tag.
+func (b backupFile) hasTag(tag string) bool {
+	return b.Record != nil && arrContains(b.Record.Tags, tag)
+}
+
+// withTag returns the backups tagged with tag, in the same order.
+func withTag(backups []backupFile, tag string) []backupFile {
+	var tagged []backupFile
+	for _, b := range backups {
+		if b.hasTag(tag) {
+			tagged = append(tagged, b)
+		}
+	}
+	return tagged
+}
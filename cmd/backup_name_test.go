@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBackupName(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		serial      int
+		compression string
+		archive     bool
+		encrypted   bool
+		legacy      bool
+	}{
+		{"nginx.conf-20250503T142530-1", "nginx.conf", 1, "", false, false, false},
+		{"my-app.conf-20250503T142530-2", "my-app.conf", 2, "", false, false, false},
+		{"docker-compose.yml-20250503T142530-12", "docker-compose.yml", 12, "", false, false, false},
+		{"app-1-20250503T142530-1", "app-1", 1, "", false, false, false},
+		{"release-20240101-20250503T142530-3", "release-20240101", 3, "", false, false, false},
+		{"backup-20250101T000000-1-20250503T142530-1", "backup-20250101T000000-1", 1, "", false, false, false},
+		{"nginx.conf-2025May3-2", "nginx.conf", 2, "", false, false, true},
+		{"my-app.conf-2024December31-1", "my-app.conf", 1, "", false, false, true},
+		{"nginx-20250503T142530-1.tar", "nginx", 1, "", true, false, false},
+		{"nginx.conf-20250503T142530-1.gz", "nginx.conf", 1, "gzip", false, false, false},
+		{"nginx.conf-20250503T142530-1.zst", "nginx.conf", 1, "zstd", false, false, false},
+		{"nginx.conf-20250503T142530-1.ref", "nginx.conf", 1, "dedup", false, false, false},
+		{"nginx.conf-20250503T142530-1.age", "nginx.conf", 1, "", false, true, false},
+		{"nginx-20250503T142530-4.tar.zst.age", "nginx", 4, "zstd", true, true, false},
+		{"my-app.conf-2025May3-2.gz", "my-app.conf", 2, "gzip", false, false, true},
+	}
+	for _, tt := range tests {
+		b, ok := parseBackupName(tt.name)
+		if ok == false {
+			t.Errorf("parseBackupName(%q) is not a backup name", tt.name)
+			continue
+		}
+		if b.File != tt.file || b.Serial != tt.serial || b.Compression != tt.compression || b.Archive != tt.archive || b.Encrypted != tt.encrypted || b.Legacy != tt.legacy {
+			t.Errorf("parseBackupName(%q) = %+v", tt.name, b)
+		}
+		if got := b.String(); got != tt.name {
+			t.Errorf("parseBackupName(%q).String() = %q", tt.name, got)
+		}
+	}
+}
+
+func TestParseBackupNameTime(t *testing.T) {
+	b, ok := parseBackupName("my-app.conf-20250503T142530-1")
+	if ok == false {
+		t.Fatal("not a backup name")
+	}
+	want := time.Date(2025, time.May, 3, 14, 25, 30, 0, time.Local)
+	if b.Time.Equal(want) == false {
+		t.Errorf("time = %v, want %v", b.Time, want)
+	}
+	b, ok = parseBackupName("nginx.conf-2025May3-2")
+	if ok == false {
+		t.Fatal("not a backup name")
+	}
+	want = time.Date(2025, time.May, 3, 0, 0, 0, 0, time.Local)
+	if b.Time.Equal(want) == false {
+		t.Errorf("legacy time = %v, want %v", b.Time, want)
+	}
+}
+
+func TestParseBackupNameRejects(t *testing.T) {
+	names := []string{
+		"nginx.conf",
+		"my-app.conf",
+		"docker-compose.yml",
+		"app-1",
+		"nginx.conf-1",
+		"nginx.conf-20250503T142530-0",
+		"nginx.conf-20250503T142530-01",
+		"nginx.conf-20250503T142530",
+		"nginx.conf-20251303T142530-1",
+		"nginx.conf-2025Foo3-1",
+		"-20250503T142530-1",
+		".nginx.conf-20250503T142530-1.linate-tmp-123",
+		"manifest.json",
+	}
+	for _, name := range names {
+		if b, ok := parseBackupName(name); ok {
+			t.Errorf("parseBackupName(%q) = %+v, want no backup name", name, b)
+		}
+	}
+}
+
+func TestNewBackupNameRoundTrip(t *testing.T) {
+	taken := time.Date(2025, time.May, 3, 14, 25, 30, 999, time.Local)
+	for _, compression := range []string{"", "gzip", "zstd", "dedup"} {
+		for _, file := range []string{"nginx.conf", "my-app.conf", "docker-compose.yml", "app-1", "2025May3"} {
+			n := newBackupName(file, taken, 3, compression)
+			b, ok := parseBackupName(n.String())
+			if ok == false {
+				t.Errorf("%q is not a backup name", n.String())
+				continue
+			}
+			if b != n {
+				t.Errorf("parseBackupName(%q) = %+v, want %+v", n.String(), b, n)
+			}
+		}
+	}
+}
+
+func TestSortBackups(t *testing.T) {
+	names := []string{
+		"nginx.conf-2025May3-1",
+		"nginx.conf-20250503T142530-2",
+		"nginx.conf-20250504T080000-1",
+		"nginx.conf-20250503T142530-10",
+		"nginx.conf-20250503T142530-1",
+		"nginx.conf-20250502T235959-1.gz",
+	}
+	var backups []backupFile
+	for _, name := range names {
+		b, ok := parseBackupName(name)
+		if ok == false {
+			t.Fatalf("%q is not a backup name", name)
+		}
+		backups = append(backups, backupFile{backupName: b, Name: name})
+	}
+	sortBackups(backups)
+	want := []string{
+		"nginx.conf-20250504T080000-1",
+		"nginx.conf-20250503T142530-10",
+		"nginx.conf-20250503T142530-2",
+		"nginx.conf-20250503T142530-1",
+		"nginx.conf-2025May3-1",
+		"nginx.conf-20250502T235959-1.gz",
+	}
+	for i := range want {
+		if backups[i].Name != want[i] {
+			t.Errorf("backup %d is %q, want %q", i, backups[i].Name, want[i])
+		}
+	}
+}
+
+func TestMigratedName(t *testing.T) {
+	for _, name := range []string{
+		"nginx.conf-2025May3-2",
+		"nginx-2025May3-1.tar",
+		"nginx.conf-2025May3-1.age",
+		"nginx-2025May3-3.tar.gz.age",
+		"my-app.conf-2025May3-1.zst",
+	} {
+		old, ok := parseBackupName(name)
+		if ok == false {
+			t.Fatalf("%q is not a backup name", name)
+		}
+		n := migratedName(backupFile{backupName: old, Name: name})
+		b, ok := parseBackupName(n.String())
+		if ok == false {
+			t.Errorf("%q migrates to %q, not a backup name", name, n.String())
+			continue
+		}
+		if b.Legacy || b.File != old.File || b.Serial != old.Serial || b.Compression != old.Compression || b.Archive != old.Archive || b.Encrypted != old.Encrypted {
+			t.Errorf("%q migrates to %+v, want the fields of %+v", name, b, old)
+		}
+		if b.Time.Equal(old.Time) == false {
+			t.Errorf("%q migrates to the time %v, want %v", name, b.Time, old.Time)
+		}
+	}
+}
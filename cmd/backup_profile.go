@@ -0,0 +1,542 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	backUpCmd.AddCommand(profileBackupCmd)
+	profileBackupCmd.Flags().StringP("profile", "p", "", "Show the sets of this profile.")
+	profileBackupCmd.Flags().String("set", "", "Show the backups of this set of the profile.")
+	addStoreFlag(profileBackupCmd)
+}
+
+var profileBackupCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "Show the profiles of the config file and their backup sets.",
+	Long: `Show the profiles of the config file and their backup sets. A profile is a named list of paths and globs
+under backup.profiles in the config file. bk take --profile backs up all of them as one set, with one shared time and
+a set id like nginx-20250503T101500, and bk restore --profile --set restores the whole set together. Directories of a
+profile are backed up as tar archives.`,
+	Run: profile_backup,
+}
+
+// profileSet is a backup set of a profile, the backups taken together by one bk take
+// --profile.
+type profileSet struct {
+	ID      string
+	Time    time.Time
+	Backups []backupFile
+}
+
+// getProfile returns the profile of the config file called name and exits when
+// there is none.
+func getProfile(name string) profileConfig {
+	p, ok := getConfig().Backup.Profiles[name]
+	if ok == false {
+		exitWithError(fmt.Sprintf("Profile '%s' does not exist. Please add it to backup.profiles in the config file.\n", name))
+	}
+	return p
+}
+
+// isGlob reports whether a path of a profile is a glob.
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// expandProfile returns the files and directories of a profile, sorted. A path that
+// is not a glob must exist, a glob may match nothing. Backups and the files of
+// linate matched by a glob are left out.
+func expandProfile(p profileConfig) ([]string, error) {
+	seen := map[string]bool{}
+	var paths []string
+	for _, pattern := range p.Paths {
+		if filepath.IsAbs(pattern) == false {
+			return nil, fmt.Errorf("'%s' is not an absolute path", pattern)
+		}
+		matches := []string{filepath.Clean(pattern)}
+		if isGlob(pattern) {
+			var e error
+			matches, e = filepath.Glob(pattern)
+			if e != nil {
+				return nil, fmt.Errorf("invalid glob '%s': %v", pattern, e)
+			}
+		} else if fileExists(pattern) == false {
+			return nil, fmt.Errorf("'%s' does not exist", pattern)
+		}
+		for _, path := range matches {
+			name := filepath.Base(path)
+			if _, ok := parseBackupName(name); ok || name == sidecarName || name == chunkDirName || name == historyDirName || strings.Contains(name, ".linate-tmp-") {
+				continue
+			}
+			if seen[path] == false {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// profileIndexes returns the manifests that may record the backups of a profile:
+// the store, or the hidden manifests of the directories of its paths.
+func profileIndexes(p profileConfig, store *backupStore) []*backupStore {
+	if store != nil {
+		return []*backupStore{store}
+	}
+	seen := map[string]bool{}
+	var indexes []*backupStore
+	for _, pattern := range p.Paths {
+		dirs := []string{filepath.Dir(pattern)}
+		if isGlob(dirs[0]) {
+			dirs, _ = filepath.Glob(dirs[0])
+		}
+		for _, dir := range dirs {
+			if seen[dir] == false && dirExists(dir) {
+				seen[dir] = true
+				indexes = append(indexes, sidecarOf(dir))
+			}
+		}
+	}
+	return indexes
+}
+
+// profileSets returns the backup sets of a profile, newest first. Backups whose file
+// is missing are left out.
+func profileSets(name string, p profileConfig, store *backupStore) ([]profileSet, error) {
+	byID := map[string]*profileSet{}
+	for _, index := range profileIndexes(p, store) {
+		m, e := index.loadManifest()
+		if e != nil {
+			return nil, e
+		}
+		for i := range m.Backups {
+			r := &m.Backups[i]
+			if r.Profile != name || r.Set == "" {
+				continue
+			}
+			b, ok := index.backupOf(r)
+			if ok == false {
+				continue
+			}
+			if byID[r.Set] == nil {
+				byID[r.Set] = &profileSet{ID: r.Set, Time: r.Time}
+			}
+			byID[r.Set].Backups = append(byID[r.Set].Backups, b)
+		}
+	}
+	var sets []profileSet
+	for _, set := range byID {
+		sort.Slice(set.Backups, func(i, j int) bool {
+			return set.Backups[i].Record.Source < set.Backups[j].Record.Source
+		})
+		sets = append(sets, *set)
+	}
+	sort.Slice(sets, func(i, j int) bool {
+		if sets[i].Time.Equal(sets[j].Time) {
+			return sets[i].ID > sets[j].ID
+		}
+		return sets[i].Time.After(sets[j].Time)
+	})
+	return sets, nil
+}
+
+// findProfileSet returns the set of a profile with the id, the newest set when id is
+// empty.
+func findProfileSet(name string, p profileConfig, store *backupStore, id string) (*profileSet, error) {
+	sets, e := profileSets(name, p, store)
+	if e != nil {
+		return nil, e
+	}
+	for i := range sets {
+		if id == "" || sets[i].ID == id {
+			return &sets[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// newSetID returns the id of a new set of a profile taken at t, unique among the
+// sets of the profile.
+func newSetID(name string, p profileConfig, store *backupStore, t time.Time) (string, error) {
+	sets, e := profileSets(name, p, store)
+	if e != nil {
+		return "", e
+	}
+	taken := map[string]bool{}
+	for _, set := range sets {
+		taken[set.ID] = true
+	}
+	id := name + "-" + t.Format(backupTimeLayout)
+	for i := 2; taken[id]; i++ {
+		id = fmt.Sprintf("%s-%s-%d", name, t.Format(backupTimeLayout), i)
+	}
+	return id, nil
+}
+
+// takeProfile backs up every file of a profile with one time and set id. When a
+// backup fails the backups taken so far are removed, a set is complete or missing.
+func takeProfile(name string, opts backupOptions, store *backupStore) {
+	p := getProfile(name)
+	paths, e := expandProfile(p)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Invalid profile '%s', %v.\n", name, e))
+	}
+	if len(paths) == 0 {
+		exitWithError(fmt.Sprintf("No file of the profile '%s' exists.\n", name))
+	}
+	opts.Time = time.Now()
+	opts.Profile = name
+	opts.Set, e = newSetID(name, p, store, opts.Time)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the backups of the profile '%s'. %v\n", name, e))
+	}
+
+	var taken []string
+	var lost []string
+	for _, path := range paths {
+		loc := locationOf(path, store)
+		o := opts
+		o.Recursive = dirExists(path + "/")
+		backup, l, e := createBackup(loc, o)
+		if e != nil {
+			removeTaken(taken, store)
+			exitOnHookError(e, "The set has not been taken.")
+			exitOnLockError(e, "The set has not been taken.")
+			exitOnQuotaError(e, "The set has not been taken.")
+			exitWithError(fmt.Sprintf("%sCan not create the backup of '%s', the set has not been taken. %v%s\n", colors["red"], path, e, colors["reset"]))
+		}
+		taken = append(taken, backup)
+		lost = append(lost, l...)
+	}
+	fmt.Printf("%slinate successfully created the set '%s' of %d backup file(s)%s\n", colors["green"], opts.Set, len(taken), colors["reset"])
+	for _, b := range taken {
+		fmt.Printf("  %s\n", b)
+	}
+	printLostMetadata(lost)
+}
+
+// removeTaken removes the backups of an incomplete set and their records.
+func removeTaken(taken []string, store *backupStore) {
+	for _, b := range taken {
+		os.Remove(b)
+		if store != nil {
+			store.removeRecord(b)
+		} else {
+			sidecarOf(filepath.Dir(b)).removeRecord(b)
+		}
+	}
+}
+
+// stagedRestore is a file or directory of a set restored next to it, it replaces
+// the current one when every file of the set is ready.
+type stagedRestore struct {
+	loc    backupLocation
+	chosen *backupFile
+	// tmp is the restored file or directory until the swap, then the previous one,
+	// empty when there was none
+	tmp     string
+	swapped bool
+	sum     string
+	lost    []string
+	stop    func()
+}
+
+// stage restores the backup of r next to its file or directory.
+func (r *stagedRestore) stage() error {
+	var e error
+	if r.chosen.Archive {
+		r.tmp, e = os.MkdirTemp(r.loc.Dir, "."+r.loc.File+".linate-tmp-")
+		if e != nil {
+			return e
+		}
+		r.stop = removeOnInterrupt(r.tmp)
+		f, e := openBackup(r.chosen.Path())
+		if e != nil {
+			return e
+		}
+		r.lost, e = extractArchive(f, r.tmp)
+		f.Close()
+		if r.chosen.Record != nil {
+			r.sum = r.chosen.Record.Checksum
+		}
+		return e
+	}
+	src := r.chosen.Path()
+	r.tmp, r.sum, r.lost, e = stageWrite(r.loc.Source(), "", src, func(tmp string) (string, error) {
+		return copyFile(src, tmp, r.chosen.encoding(), "")
+	})
+	if e == nil {
+		r.stop = removeOnInterrupt(r.tmp)
+	}
+	return e
+}
+
+// swap puts the staged file or directory in place of the current one, which is
+// kept in tmp until done or undo.
+func (r *stagedRestore) swap() error {
+	// An interrupt must not remove what is swapped in
+	r.stop()
+	r.stop = func() {}
+	if r.chosen.Archive {
+		old, e := swapDir(r.tmp, r.loc.Source())
+		if e != nil {
+			return e
+		}
+		r.tmp = old
+		r.swapped = true
+		return nil
+	}
+	old := ""
+	if fileExists(r.loc.Source()) {
+		f, e := os.CreateTemp(r.loc.Dir, "."+r.loc.File+".linate-old-")
+		if e != nil {
+			return e
+		}
+		f.Close()
+		old = f.Name()
+		if e = os.Rename(r.loc.Source(), old); e != nil {
+			os.Remove(old)
+			return e
+		}
+	}
+	if e := os.Rename(r.tmp, r.loc.Source()); e != nil {
+		if old != "" {
+			os.Rename(old, r.loc.Source())
+		}
+		return e
+	}
+	r.tmp = old
+	r.swapped = true
+	return nil
+}
+
+// undo puts the previous file or directory back, or removes what was staged.
+func (r *stagedRestore) undo() {
+	if r.stop != nil {
+		defer r.stop()
+	}
+	if r.swapped == false {
+		if r.tmp != "" {
+			os.RemoveAll(r.tmp)
+		}
+		return
+	}
+	if r.tmp == "" || fileExists(r.tmp) == false {
+		os.RemoveAll(r.loc.Source())
+		return
+	}
+	if r.chosen.Archive {
+		if restored, e := swapDir(r.tmp, r.loc.Source()); e == nil {
+			os.RemoveAll(restored)
+		}
+		return
+	}
+	os.Rename(r.tmp, r.loc.Source())
+}
+
+// done removes the previous file or directory, what a directory backup left out is
+// carried over first.
+func (r *stagedRestore) done() {
+	if r.tmp == "" || fileExists(r.tmp) == false {
+		return
+	}
+	if r.chosen.Archive {
+		if e := carryLeftOut(r.tmp, r.loc.Source()); e != nil {
+			fmt.Printf("%sSome files left out of the backup could not be kept, they are still in '%s'. %v%s\n", colors["yellow"], r.tmp, e, colors["reset"])
+			return
+		}
+	}
+	os.RemoveAll(r.tmp)
+}
+
+// restoreProfile restores every backup of a set of a profile together. The current
+// files are backed up as a new set of the profile first, so the restore can be
+// rolled back the same way.
+func restoreProfile(name string, id string, store *backupStore, yes bool) {
+	p := getProfile(name)
+	set, e := findProfileSet(name, p, store, id)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the backups of the profile '%s'. %v\n", name, e))
+	}
+	if set == nil {
+		if id != "" {
+			exitWithError(fmt.Sprintf("Set '%s' of the profile '%s' does not exist.\n", id, name))
+		}
+		exitWithError("No backup set found\n")
+	}
+
+	// Show what will change
+	var changed []backupFile
+	for i := range set.Backups {
+		b := &set.Backups[i]
+		loc := locationOf(b.Record.Source, store)
+		if b.Archive {
+			if showDirDiff(loc, b) == false {
+				fmt.Printf("%sThe files in '%s' are identical to the backup '%s'. Only their metadata will be restored.%s\n\n", colors["green"], loc.Source(), b.Name, colors["reset"])
+			}
+		} else if showFileDiff(loc, b) == false {
+			fmt.Printf("%sThe file '%s' is identical to the backup '%s'.%s\n", colors["green"], loc.Source(), b.Name, colors["reset"])
+			continue
+		}
+		changed = append(changed, *b)
+	}
+	if len(changed) == 0 {
+		fmt.Printf("%sEvery file of the set '%s' is identical to its backup. Nothing to restore.%s\n", colors["green"], set.ID, colors["reset"])
+		return
+	}
+
+	if yes == false {
+		ok := yesNoPrompt(fmt.Sprintf("Do you want to restore %d file(s) from the set '%s'?", len(changed), set.ID), false)
+		if ok == false {
+			return
+		}
+	}
+
+	// Keep the current files as a set, complete or not at all
+	now := time.Now()
+	safetySet, e := newSetID(name, p, store, now)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the backups of the profile '%s'. %v\n", name, e))
+	}
+	var taken []string
+	for i := range changed {
+		b := &changed[i]
+		loc := locationOf(b.Record.Source, store)
+		if fileExists(loc.Source()) == false {
+			continue
+		}
+		opts := safetyOptions(store, b)
+		opts.Time = now
+		opts.Profile = name
+		opts.Set = safetySet
+		opts.Recursive = b.Archive
+		safety, _, e := createBackup(loc, opts)
+		if e != nil {
+			removeTaken(taken, store)
+			exitOnHookError(e, "Nothing has been restored.")
+			exitWithError(fmt.Sprintf("%sCan not take a backup of '%s', nothing has been restored. %v%s\n", colors["red"], loc.Source(), e, colors["reset"]))
+		}
+		taken = append(taken, safety)
+	}
+
+	// Restore every file next to it first, then swap them all in. When anything
+	// fails the files swapped so far are put back
+	staged := make([]*stagedRestore, len(changed))
+	rollback := func(e error, what string) {
+		for i := len(staged) - 1; i >= 0; i-- {
+			if staged[i] != nil {
+				staged[i].undo()
+			}
+		}
+		exitWithError(fmt.Sprintf("%sCan not %s, nothing has been restored. The current files are kept in the set '%s'. %v%s\n", colors["red"], what, safetySet, e, colors["reset"]))
+	}
+	for i := range changed {
+		staged[i] = &stagedRestore{loc: locationOf(changed[i].Record.Source, store), chosen: &changed[i]}
+		if e := staged[i].stage(); e != nil {
+			rollback(e, fmt.Sprintf("restore '%s' from '%s'", staged[i].loc.Source(), changed[i].Name))
+		}
+	}
+	for _, r := range staged {
+		if e := r.swap(); e != nil {
+			rollback(e, fmt.Sprintf("replace '%s'", r.loc.Source()))
+		}
+	}
+
+	var lost []string
+	for _, r := range staged {
+		r.done()
+		syncDir(r.loc.Dir)
+		lost = append(lost, r.lost...)
+		fmt.Printf("%slinate successfully restored '%s' from '%s'%s\n", colors["green"], r.loc.Source(), r.chosen.Name, colors["reset"])
+	}
+	printLostMetadata(lost)
+	fmt.Printf("%slinate successfully restored the set '%s'. The previous files are kept in the set '%s'.%s\n", colors["green"], set.ID, safetySet, colors["reset"])
+	for _, r := range staged {
+		runPostHooks(hookPostRestore, hookEnv{Source: r.loc.Source(), Backup: r.chosen.Path(), Checksum: r.sum, Store: r.loc.Store})
+	}
+}
+
+func profile_backup(cmd *cobra.Command, args []string) {
+	name, _ := cmd.Flags().GetString("profile")
+	id, _ := cmd.Flags().GetString("set")
+	store := getStore(cmd)
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+
+	if name == "" {
+		if id != "" {
+			exitWithError("--set needs the --profile flag.\n")
+		}
+		profiles := getConfig().Backup.Profiles
+		if len(profiles) == 0 {
+			fmt.Printf("No profile found. Profiles are set in backup.profiles of the config file.\n")
+			return
+		}
+		var names []string
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		tbl := table.New("Profile", "Paths", "Sets", "Last Set")
+		tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+		for _, n := range names {
+			sets, e := profileSets(n, profiles[n], store)
+			if e != nil {
+				exitWithError(fmt.Sprintf("Can not read the backups of the profile '%s'. %v\n", n, e))
+			}
+			last := "-"
+			if len(sets) > 0 {
+				last = sets[0].ID
+			}
+			tbl.AddRow(n, strings.Join(profiles[n].Paths, " "), len(sets), last)
+		}
+		tbl.Print()
+		return
+	}
+
+	p := getProfile(name)
+	if id != "" {
+		set, e := findProfileSet(name, p, store, id)
+		if e != nil {
+			exitWithError(fmt.Sprintf("Can not read the backups of the profile '%s'. %v\n", name, e))
+		}
+		if set == nil {
+			exitWithError(fmt.Sprintf("Set '%s' of the profile '%s' does not exist.\n", id, name))
+		}
+		tbl := table.New("File", "Backup", "Size")
+		tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+		for _, b := range set.Backups {
+			tbl.AddRow(b.Record.Source, b.Path(), fmt.Sprintf("%v byte", b.Info.Size()))
+		}
+		tbl.Print()
+		return
+	}
+
+	sets, e := profileSets(name, p, store)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the backups of the profile '%s'. %v\n", name, e))
+	}
+	if len(sets) == 0 {
+		fmt.Printf("No backup set found\n")
+		return
+	}
+	fmt.Printf("Total number of sets:%s %d%s\n", colors["yellow"], len(sets), colors["reset"])
+	tbl := table.New("Set", "Date | Time", "Files")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	for _, set := range sets {
+		tm := set.Time.Local()
+		tbl.AddRow(set.ID, fmt.Sprintf("%v-%v-%v | %v:%v", tm.Year(), tm.Month(), tm.Day(), tm.Hour(), tm.Minute()), len(set.Backups))
+	}
+	tbl.Print()
+}
@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	backUpCmd.AddCommand(pruneBackupCmd)
+	pruneBackupCmd.Flags().StringP("dir", "d", "", "Enter the directory of the file, absolute directory not relative.")
+	pruneBackupCmd.Flags().StringP("file", "f", "", "Enter the filename. Without it every file in the directory is pruned.")
+	pruneBackupCmd.Flags().Bool("all", false, "Prune every file of the backup store.")
+	addRetentionFlags(pruneBackupCmd)
+	pruneBackupCmd.Flags().Bool("dry-run", false, "Only show the backups that would be deleted.")
+	pruneBackupCmd.Flags().BoolP("yes", "y", false, "Do not ask for confirmation.")
+	addStoreFlag(pruneBackupCmd)
+	pruneBackupCmd.MarkFlagsMutuallyExclusive("file", "all")
+}
+
+var pruneBackupCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete backups according to a retention policy.",
+	Long: `Delete backups according to a retention policy. For every file the newest --keep-last backups are kept,
+and the newest backup of each of the last --keep-daily days, --keep-weekly weeks and --keep-monthly months.
+Like restic, every rule is applied on its own, so one backup can be kept by several rules. --max-total-size
+then deletes the oldest of the remaining backups until they fit, the newest backup of a file is always kept.
+Without flags the policy in the config file is used.`,
+	Run: prune_backup,
+}
+
+// retentionPolicy decides which backups of a file bk prune keeps.
+type retentionPolicy struct {
+	KeepLast     int
+	KeepDaily    int
+	KeepWeekly   int
+	KeepMonthly  int
+	MaxTotalSize int64
+}
+
+func (p retentionPolicy) isEmpty() bool {
+	return p.KeepLast == 0 && p.KeepDaily == 0 && p.KeepWeekly == 0 && p.KeepMonthly == 0 && p.MaxTotalSize == 0
+}
+
+// hasBuckets reports whether the policy keeps backups by count or by period.
+func (p retentionPolicy) hasBuckets() bool {
+	return p.KeepLast != 0 || p.KeepDaily != 0 || p.KeepWeekly != 0 || p.KeepMonthly != 0
+}
+
+// keep returns which of the backups of one file, newest first, the keep rules keep.
+func (p retentionPolicy) keep(backups []backupFile) []bool {
+	kept := make([]bool, len(backups))
+	if p.hasBuckets() == false {
+		for i := range kept {
+			kept[i] = true
+		}
+		return kept
+	}
+	rules := []struct {
+		count  int
+		bucket func(b backupFile) string
+	}{
+		{p.KeepLast, func(b backupFile) string { return b.Name }},
+		{p.KeepDaily, func(b backupFile) string { return b.takenAt().Format("2006-01-02") }},
+		{p.KeepWeekly, func(b backupFile) string {
+			y, w := b.takenAt().ISOWeek()
+			return fmt.Sprintf("%d-%d", y, w)
+		}},
+		{p.KeepMonthly, func(b backupFile) string { return b.takenAt().Format("2006-01") }},
+	}
+	for _, rule := range rules {
+		left := rule.count
+		last := ""
+		for i, b := range backups {
+			if left == 0 {
+				break
+			}
+			bucket := rule.bucket(b)
+			if bucket == last {
+				continue
+			}
+			last = bucket
+			kept[i] = true
+			left -= 1
+		}
+	}
+	return kept
+}
+
+// forget returns the backups of every group that the policy deletes, oldest first.
+func (p retentionPolicy) forget(groups map[string][]backupFile) []backupFile {
+	var kept, removed []backupFile
+	for _, backups := range groups {
+		k := p.keep(backups)
+		for i, b := range backups {
+			if k[i] {
+				kept = append(kept, b)
+			} else {
+				removed = append(removed, b)
+			}
+		}
+	}
+
+	if p.MaxTotalSize > 0 {
+		var total int64
+		for _, b := range kept {
+			total += b.Info.Size()
+		}
+		sortBackups(kept)
+		// Oldest first, but never the newest backup of a file
+		for i := len(kept) - 1; i >= 0 && total > p.MaxTotalSize; i-- {
+			if isNewestOf(kept[i], groups) {
+				continue
+			}
+			total -= kept[i].Info.Size()
+			removed = append(removed, kept[i])
+		}
+	}
+
+	sort.Slice(removed, func(i, j int) bool {
+		return removed[i].Before(removed[j].backupName)
+	})
+	return removed
+}
+
+func isNewestOf(b backupFile, groups map[string][]backupFile) bool {
+	for _, backups := range groups {
+		if len(backups) > 0 && backups[0].Path() == b.Path() {
+			return true
+		}
+	}
+	return false
+}
+
+// addRetentionFlags adds the flags of a retention policy to a bk command.
+func addRetentionFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("keep-last", 0, "Keep the newest n backups.")
+	cmd.Flags().Int("keep-daily", 0, "Keep the newest backup of each of the last n days.")
+	cmd.Flags().Int("keep-weekly", 0, "Keep the newest backup of each of the last n weeks.")
+	cmd.Flags().Int("keep-monthly", 0, "Keep the newest backup of each of the last n months.")
+	cmd.Flags().String("max-total-size", "", "Delete the oldest backups until the rest fit in this size, e.g. 500M or 1G.")
+}
+
+// getRetentionPolicy reads the retention flags of a bk command, or the policy in the
+// config file when none is set.
+func getRetentionPolicy(cmd *cobra.Command) retentionPolicy {
+	var p retentionPolicy
+	var maxSize string
+	p.KeepLast, _ = cmd.Flags().GetInt("keep-last")
+	p.KeepDaily, _ = cmd.Flags().GetInt("keep-daily")
+	p.KeepWeekly, _ = cmd.Flags().GetInt("keep-weekly")
+	p.KeepMonthly, _ = cmd.Flags().GetInt("keep-monthly")
+	maxSize, _ = cmd.Flags().GetString("max-total-size")
+	if p.hasBuckets() == false && maxSize == "" {
+		c := getConfig().Backup.Retention
+		p.KeepLast, p.KeepDaily, p.KeepWeekly, p.KeepMonthly = c.KeepLast, c.KeepDaily, c.KeepWeekly, c.KeepMonthly
+		maxSize = c.MaxTotalSize
+	}
+	if p.KeepLast < 0 || p.KeepDaily < 0 || p.KeepWeekly < 0 || p.KeepMonthly < 0 {
+		exitWithError("The number of backups to keep can not be negative.\n")
+	}
+	if maxSize != "" {
+		size, e := parseSize(maxSize)
+		if e != nil {
+			exitWithError(fmt.Sprintf("Invalid maximum total size '%s'. Please use a size like 500M or 1G.\n", maxSize))
+		}
+		p.MaxTotalSize = size
+	}
+	return p
+}
+
+// deleteBackups removes backups and reports each one, it returns how many failed.
+func deleteBackups(backups []backupFile, store *backupStore) int {
+	failed := 0
+	for _, b := range backups {
+		e := backupLocation{Store: store}.remove(b)
+		var hookErr *hookError
+		switch {
+		case e == nil:
+			fmt.Printf("%sFile %s has been deleted successfully%s\n", colors["green"], b.Name, colors["reset"])
+		case errors.As(e, &hookErr):
+			failed += 1
+			fmt.Printf("%sFile %s has not been deleted, %v%s\n", colors["red"], b.Name, hookErr, colors["reset"])
+		default:
+			failed += 1
+			fmt.Printf("%sFile %s could not be deleted. Check file permission or run as the super user.%s\n", colors["red"], b.Name, colors["reset"])
+		}
+	}
+	return failed
+}
+
+func prune_backup(cmd *cobra.Command, args []string) {
+	file, _ := cmd.Flags().GetString("file")
+	all, _ := cmd.Flags().GetBool("all")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	yes, _ := cmd.Flags().GetBool("yes")
+	policy := getRetentionPolicy(cmd)
+	if policy.isEmpty() {
+		exitWithError("No retention policy. Please use the --keep-* or --max-total-size flags or set backup.retention in the config file.\n")
+	}
+
+	var groups map[string][]backupFile
+	var e error
+	store := getStore(cmd)
+	switch {
+	case all:
+		if store == nil {
+			exitWithError("--all needs a backup store. Please use the --store flag or set backup.store in the config file.\n")
+		}
+		groups, e = listBackupGroups("", store)
+	case file != "":
+		loc := getBackupLocation(cmd)
+		var backups []backupFile
+		backups, e = loc.list()
+		groups = map[string][]backupFile{loc.Source(): backups}
+	default:
+		loc := getBackupLocation(cmd)
+		groups, e = listBackupGroups(loc.Dir, store)
+	}
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the backups. %v\n", e))
+	}
+
+	removed := policy.forget(groups)
+	if len(removed) == 0 {
+		fmt.Printf("Nothing to prune\n")
+		return
+	}
+	rows := make([]FileInfo, len(removed))
+	for i, b := range removed {
+		rows[i] = newFileInfo(b)
+	}
+	if dryRun {
+		fmt.Printf("%sFollowing %d backup file(s) would be deleted%s\n\n", colors["yellow"], len(removed), colors["reset"])
+		printBackupTable(rows)
+		return
+	}
+	fmt.Printf("%sFollowing %d backup file(s) will be deleted%s\n\n", colors["red"], len(removed), colors["reset"])
+	printBackupTable(rows)
+	fmt.Printf("\n")
+	if yes == false {
+		ok := yesNoPrompt("Do you want to delete?", false)
+		if ok == false {
+			return
+		}
+	}
+	failed := deleteBackups(removed, store)
+	collectChunks(store)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,359 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	backUpCmd.AddCommand(restoreBackupCmd)
+	restoreBackupCmd.Flags().StringP("dir", "d", "", "Enter the directory of the file, absolute directory not relative.")
+	restoreBackupCmd.Flags().StringP("file", "f", "", "Enter the filename")
+	restoreBackupCmd.Flags().StringP("backup", "b", "", "Name of the backup file to restore.")
+	restoreBackupCmd.Flags().Bool("latest", false, "Restore the newest backup. This is the default.")
+	restoreBackupCmd.Flags().String("before", "", "Restore the newest backup taken before this date (YYYY-MM-DD).")
+	restoreBackupCmd.Flags().StringP("member", "m", "", "Only restore this file of a directory backup, relative to the directory.")
+	restoreBackupCmd.Flags().String("tag", "", "Restore the newest backup with this tag.")
+	restoreBackupCmd.Flags().BoolP("yes", "y", false, "Do not ask for confirmation.")
+	restoreBackupCmd.Flags().String("profile", "", "Restore every file of a backup set of this profile, see bk profile.")
+	restoreBackupCmd.Flags().String("set", "", "Set of the profile to restore. Default is the newest set.")
+	restoreBackupCmd.Flags().String("rev", "", "Restore this revision of the history of the file, see bk history.")
+	restoreBackupCmd.MarkFlagsOneRequired("file", "profile")
+	restoreBackupCmd.MarkFlagsMutuallyExclusive("file", "profile")
+	restoreBackupCmd.MarkFlagsMutuallyExclusive("backup", "latest", "before")
+	for _, flag := range []string{"backup", "before", "member", "tag"} {
+		restoreBackupCmd.MarkFlagsMutuallyExclusive(flag, "profile")
+	}
+	addStoreFlag(restoreBackupCmd)
+	addTargetFlag(restoreBackupCmd)
+	restoreBackupCmd.MarkFlagsMutuallyExclusive("profile", "target")
+	for _, flag := range []string{"backup", "latest", "before", "member", "tag", "profile", "target"} {
+		restoreBackupCmd.MarkFlagsMutuallyExclusive(flag, "rev")
+	}
+}
+
+var restoreBackupCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore a file from a backup.",
+	Long: `Restore a file from a backup. The difference between the file and the backup is shown first.
+A backup of the current file is taken before it is replaced. A directory backup replaces the whole
+directory, or only one file of it with --member. With --profile every file of a backup set is restored together.
+With --rev a revision of the history of the file is restored, see bk history.`,
+	Run: restore_backup,
+}
+
+// safetyOptions returns the options of the backup of the current content taken
+// before a restore. It is encrypted like the restored backup.
+func safetyOptions(store *backupStore, chosen *backupFile) backupOptions {
+	opts := defaultOptions(store)
+	opts.Note = "before restoring " + chosen.Name
+	if chosen.Encrypted {
+		opts.Encrypt = true
+		opts.Dedup = false
+	}
+	return opts
+}
+
+func restore_backup(cmd *cobra.Command, args []string) {
+	backupName, _ := cmd.Flags().GetString("backup")
+	before, _ := cmd.Flags().GetString("before")
+	member, _ := cmd.Flags().GetString("member")
+	tag, _ := cmd.Flags().GetString("tag")
+	yes, _ := cmd.Flags().GetBool("yes")
+	set, _ := cmd.Flags().GetString("set")
+	if profile, _ := cmd.Flags().GetString("profile"); profile != "" {
+		restoreProfile(profile, set, getStore(cmd), yes)
+		return
+	}
+	if set != "" {
+		exitWithError("--set needs the --profile flag.\n")
+	}
+	loc := getBackupLocation(cmd)
+	file := loc.File
+	if rev, _ := cmd.Flags().GetString("rev"); rev != "" {
+		restoreRevision(loc, rev, yes)
+		return
+	}
+	if session := getTargetSession(cmd); session != nil {
+		// The backup of the current file is uploaded as well
+		defer session.finish()
+		loc.Store = session.staging
+		if e := session.fetch(loc.Source()); e != nil {
+			session.close()
+			exitWithError(fmt.Sprintf("Can not read the backups of '%s' in the target '%s'. %v\n", loc.Source(), session.target, e))
+		}
+	}
+
+	var beforeDate time.Time
+	if before != "" {
+		var e error
+		beforeDate, e = time.ParseInLocation("2006-01-02", before, time.Local)
+		if e != nil {
+			exitWithError(fmt.Sprintf("Invalid date '%s'. Please use the YYYY-MM-DD format.\n", before))
+		}
+	}
+
+	backups, e := loc.list()
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the backups of '%s'. %v\n", loc.Source(), e))
+	}
+
+	// Choose the backup
+	var chosen *backupFile
+	for i := range backups {
+		if backupName != "" && backups[i].Name != backupName {
+			continue
+		}
+		if before != "" && !backups[i].takenAt().Before(beforeDate) {
+			continue
+		}
+		if tag != "" && backups[i].hasTag(tag) == false {
+			continue
+		}
+		chosen = &backups[i]
+		break
+	}
+	if chosen == nil {
+		if backupName != "" {
+			exitWithError(fmt.Sprintf("Backup '%s' of the file '%s' does not exist in the directory %v\n", backupName, file, loc.BackupDir()))
+		}
+		if tag != "" {
+			exitWithError(fmt.Sprintf("No backup of the file '%s' has the tag '%s'\n", file, tag))
+		}
+		exitWithError("No backup found\n")
+	}
+
+	if chosen.Archive {
+		if member != "" {
+			restoreArchiveMember(loc, chosen, member, yes)
+		} else {
+			restoreArchive(loc, chosen, yes)
+		}
+		return
+	}
+	if member != "" {
+		exitWithError("The --member flag only works with the backup of a directory.\n")
+	}
+
+	// Show what will change
+	if showFileDiff(loc, chosen) == false {
+		fmt.Printf("%sThe file '%s' is identical to the backup '%s'. Nothing to restore.%s\n", colors["green"], file, chosen.Name, colors["reset"])
+		return
+	}
+
+	if yes == false {
+		ok := yesNoPrompt(fmt.Sprintf("Do you want to restore '%s' from '%s'?", file, chosen.Name), false)
+		if ok == false {
+			return
+		}
+	}
+	restoreFile(loc, chosen, safetyOptions(loc.Store, chosen))
+}
+
+// showFileDiff prints the difference between the file of loc and a backup, false
+// when they are identical.
+func showFileDiff(loc backupLocation, chosen *backupFile) bool {
+	current, e := os.ReadFile(loc.Source())
+	if e != nil && !os.IsNotExist(e) {
+		exitWithError(fmt.Sprintf("Can not read the file '%s'. Please run as the superuser if your user does not have permission to read it.\n", loc.Source()))
+	}
+	// A missing file differs from an empty backup
+	missing := os.IsNotExist(e)
+	restored, e := readBackup(chosen.Path())
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the backup file '%s'. Please run as the superuser if your user does not have permission to read it.\n", chosen.Path()))
+	}
+	if bytes.Equal(current, restored) && missing == false {
+		return false
+	}
+	printContentDiff(loc.File, chosen.Name, current, restored)
+	fmt.Printf("\n")
+	return true
+}
+
+// restoreFile replaces the file of loc with a backup. The current file is backed up
+// with opts first.
+func restoreFile(loc backupLocation, chosen *backupFile, opts backupOptions) {
+	// Keep the current content before replacing it
+	if fileExists(loc.Source()) {
+		safety, _, e := createBackup(loc, opts)
+		exitOnHookError(e, "Nothing has been restored.")
+		if e != nil {
+			exitWithError(fmt.Sprintf("%sCan not take a backup of the current file, nothing has been restored. %v%s\n", colors["red"], e, colors["reset"]))
+		}
+		fmt.Printf("%sThe current file has been saved as '%s'%s\n", colors["green"], safety, colors["reset"])
+	}
+
+	sum, lost, e := atomicCopyFile(chosen.Path(), loc.Source(), chosen.encoding(), "")
+	if e != nil {
+		exitWithError(fmt.Sprintf("%sCan not restore the file. %v%s\n", colors["red"], e, colors["reset"]))
+	}
+	fmt.Printf("%slinate successfully restored '%s' from '%s'%s\n", colors["green"], loc.File, chosen.Name, colors["reset"])
+	printLostMetadata(lost)
+	runPostHooks(hookPostRestore, hookEnv{Source: loc.Source(), Backup: chosen.Path(), Checksum: sum, Store: loc.Store})
+}
+
+// restoreArchive replaces the directory of loc with the content of a directory
+// backup. What the backup left out, like files matching .linateignore, is kept.
+func restoreArchive(loc backupLocation, chosen *backupFile, yes bool) {
+	if showDirDiff(loc, chosen) == false {
+		fmt.Printf("%sThe files in '%s' are identical to the backup '%s'. Only their metadata will be restored.%s\n\n", colors["green"], loc.File, chosen.Name, colors["reset"])
+	}
+
+	if yes == false {
+		ok := yesNoPrompt(fmt.Sprintf("Do you want to replace the directory '%s' with '%s'?", loc.File, chosen.Name), false)
+		if ok == false {
+			return
+		}
+	}
+	opts := safetyOptions(loc.Store, chosen)
+	opts.Recursive = true
+	restoreDir(loc, chosen, opts)
+}
+
+// showDirDiff prints the difference between the directory of loc and a directory
+// backup, false when their files are identical.
+func showDirDiff(loc backupLocation, chosen *backupFile) bool {
+	changed := false
+	r, e := openBackup(chosen.Path())
+	if e == nil {
+		var restored map[string][]byte
+		restored, e = readArchiveFiles(r)
+		r.Close()
+		if e == nil {
+			current := map[string][]byte{}
+			if dirExists(loc.Source() + "/") {
+				current, e = readTreeFiles(loc.Source())
+			}
+			if e != nil {
+				exitWithError(fmt.Sprintf("Can not read the directory '%s'. Please run as the superuser if your user does not have permission to read it.\n", loc.Source()))
+			}
+			changed = diffFileSets(loc.File, chosen.Name, current, restored)
+			if changed {
+				fmt.Printf("\n")
+			}
+		}
+	}
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the backup file '%s'. %v\n", chosen.Path(), e))
+	}
+	return changed
+}
+
+// restoreDir replaces the directory of loc with a directory backup. The current
+// directory is backed up with opts first.
+func restoreDir(loc backupLocation, chosen *backupFile, opts backupOptions) {
+	if dirExists(loc.Source() + "/") {
+		safety, _, e := createBackup(loc, opts)
+		exitOnHookError(e, "Nothing has been restored.")
+		if e != nil {
+			exitWithError(fmt.Sprintf("%sCan not take a backup of the current directory, nothing has been restored. %v%s\n", colors["red"], e, colors["reset"]))
+		}
+		fmt.Printf("%sThe current directory has been saved as '%s'%s\n", colors["green"], safety, colors["reset"])
+	}
+
+	// Extract next to the directory and swap them, so a failure leaves it untouched
+	tmp, e := os.MkdirTemp(loc.Dir, "."+loc.File+".linate-tmp-")
+	if e != nil {
+		exitWithError(fmt.Sprintf("%sCan not restore the directory. %v%s\n", colors["red"], e, colors["reset"]))
+	}
+	stop := removeOnInterrupt(tmp)
+	defer stop()
+
+	r, e := openBackup(chosen.Path())
+	if e != nil {
+		exitWithError(fmt.Sprintf("%sCan not restore the directory. %v%s\n", colors["red"], e, colors["reset"]))
+	}
+	lost, e := extractArchive(r, tmp)
+	r.Close()
+	if e != nil {
+		os.RemoveAll(tmp)
+		exitWithError(fmt.Sprintf("%sCan not restore the directory. %v%s\n", colors["red"], e, colors["reset"]))
+	}
+	old, e := swapDir(tmp, loc.Source())
+	if e != nil {
+		os.RemoveAll(tmp)
+		exitWithError(fmt.Sprintf("%sCan not restore the directory. %v%s\n", colors["red"], e, colors["reset"]))
+	}
+	e = carryLeftOut(old, loc.Source())
+	if e != nil {
+		fmt.Printf("%sSome files left out of the backup could not be kept, they are still in '%s'. %v%s\n", colors["yellow"], old, e, colors["reset"])
+	} else {
+		os.RemoveAll(old)
+	}
+	syncDir(loc.Dir)
+	fmt.Printf("%slinate successfully restored '%s' from '%s'%s\n", colors["green"], loc.File, chosen.Name, colors["reset"])
+	printLostMetadata(lost)
+	env := hookEnv{Source: loc.Source(), Backup: chosen.Path(), Store: loc.Store}
+	if chosen.Record != nil {
+		env.Checksum = chosen.Record.Checksum
+	}
+	runPostHooks(hookPostRestore, env)
+}
+
+// restoreArchiveMember restores one file of a directory backup.
+func restoreArchiveMember(loc backupLocation, chosen *backupFile, member string, yes bool) {
+	r, e := openBackup(chosen.Path())
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the backup file '%s'. %v\n", chosen.Path(), e))
+	}
+	defer r.Close()
+	hdr, content, e := findArchiveMember(r, member)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not restore '%s' from '%s'. %v\n", member, chosen.Name, e))
+	}
+	restored, e := io.ReadAll(content)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the backup file '%s'. %v\n", chosen.Path(), e))
+	}
+	target, e := memberPath(loc.Source(), hdr.Name)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not restore '%s'. %v\n", member, e))
+	}
+
+	current, e := os.ReadFile(target)
+	if e != nil && !os.IsNotExist(e) {
+		exitWithError(fmt.Sprintf("Can not read the file '%s'. Please run as the superuser if your user does not have permission to read it.\n", target))
+	}
+	if bytes.Equal(current, restored) && e == nil {
+		fmt.Printf("%sThe file '%s' is identical to '%s' in the backup '%s'. Nothing to restore.%s\n", colors["green"], target, hdr.Name, chosen.Name, colors["reset"])
+		return
+	}
+	printContentDiff(target, chosen.Name+"/"+hdr.Name, current, restored)
+	fmt.Printf("\n")
+
+	if yes == false {
+		ok := yesNoPrompt(fmt.Sprintf("Do you want to restore '%s' from '%s'?", target, chosen.Name), false)
+		if ok == false {
+			return
+		}
+	}
+
+	if fileExists(target) {
+		safety, _, e := createBackup(locationOf(target, loc.Store), safetyOptions(loc.Store, chosen))
+		exitOnHookError(e, "Nothing has been restored.")
+		if e != nil {
+			exitWithError(fmt.Sprintf("%sCan not take a backup of the current file, nothing has been restored. %v%s\n", colors["red"], e, colors["reset"]))
+		}
+		fmt.Printf("%sThe current file has been saved as '%s'%s\n", colors["green"], safety, colors["reset"])
+	} else if e = os.MkdirAll(filepath.Dir(target), 0755); e != nil {
+		exitWithError(fmt.Sprintf("%sCan not restore the file. %v%s\n", colors["red"], e, colors["reset"]))
+	}
+
+	sum, _, e := atomicWrite(target, "", "", func(tmp string) (string, error) {
+		return copyReader(bytes.NewReader(restored), tmp, "", int64(len(restored)))
+	})
+	if e != nil {
+		exitWithError(fmt.Sprintf("%sCan not restore the file. %v%s\n", colors["red"], e, colors["reset"]))
+	}
+	lost := applyHeader(target, hdr)
+	fmt.Printf("%slinate successfully restored '%s' from '%s'%s\n", colors["green"], target, chosen.Name, colors["reset"])
+	printLostMetadata(lost)
+	runPostHooks(hookPostRestore, hookEnv{Source: target, Backup: chosen.Path(), Checksum: sum, Store: loc.Store})
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShowFileDiffMissing(t *testing.T) {
+	loadedConfig = &linateConfig{}
+	dir := t.TempDir() + "/"
+	name := "empty.conf-20250503T142530-1"
+	if e := os.WriteFile(filepath.Join(dir, name), nil, 0644); e != nil {
+		t.Fatal(e)
+	}
+	b, ok := parseBackupName(name)
+	if ok == false {
+		t.Fatalf("%q is not a backup name", name)
+	}
+	chosen := &backupFile{backupName: b, Dir: dir, Name: name}
+	loc := backupLocation{Dir: dir, File: "empty.conf"}
+
+	// The file was removed, the empty backup brings it back
+	if showFileDiff(loc, chosen) == false {
+		t.Error("a missing file is identical to an empty backup")
+	}
+	if e := os.WriteFile(loc.Source(), nil, 0644); e != nil {
+		t.Fatal(e)
+	}
+	if showFileDiff(loc, chosen) {
+		t.Error("an empty file differs from an empty backup")
+	}
+}
@@ -0,0 +1,503 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	backUpCmd.AddCommand(scheduleBackupCmd)
+	scheduleBackupCmd.AddCommand(scheduleAddCmd)
+	scheduleBackupCmd.AddCommand(scheduleListCmd)
+	scheduleBackupCmd.AddCommand(scheduleRemoveCmd)
+	scheduleBackupCmd.AddCommand(scheduleRunCmd)
+	scheduleAddCmd.Flags().StringP("dir", "d", "", "Enter the directory of the file, absolute directory not relative.")
+	scheduleAddCmd.Flags().StringP("file", "f", "", "Enter the filename")
+	scheduleAddCmd.Flags().String("every", "daily", "How often the backup is taken: hourly, daily, weekly or monthly.")
+	scheduleAddCmd.Flags().Int("keep", 0, "Keep the newest n backups of the file, older ones are deleted after every run. 0 keeps every backup.")
+	scheduleAddCmd.Flags().String("name", "", "Name of the schedule. Default is made of the path of the file, e.g. etc-nginx-nginx-conf.")
+	scheduleAddCmd.Flags().StringP("compress", "c", "", "Compress the backups. Available options are none, gzip and zstd. Default is taken from the config file.")
+	scheduleAddCmd.Flags().Bool("cron", false, "Write a cron.d entry even when systemd is running.")
+	scheduleAddCmd.MarkFlagRequired("file")
+	addStoreFlag(scheduleAddCmd)
+	scheduleRemoveCmd.Flags().StringP("dir", "d", "", "Enter the directory of the file, absolute directory not relative.")
+	scheduleRemoveCmd.Flags().StringP("file", "f", "", "Remove the schedule of this file.")
+	scheduleRemoveCmd.Flags().String("name", "", "Name of the schedule to remove.")
+	scheduleRemoveCmd.MarkFlagsOneRequired("file", "name")
+	scheduleRemoveCmd.MarkFlagsMutuallyExclusive("file", "name")
+	scheduleRunCmd.Flags().String("name", "", "Name of the schedule.")
+	scheduleRunCmd.Flags().String("file", "", "Absolute path of the file.")
+	scheduleRunCmd.Flags().Int("keep", 0, "Keep the newest n backups of the file.")
+	scheduleRunCmd.Flags().StringP("compress", "c", "", "Compress the backup.")
+	scheduleRunCmd.MarkFlagRequired("name")
+	scheduleRunCmd.MarkFlagRequired("file")
+	addStoreFlag(scheduleRunCmd)
+}
+
+var scheduleBackupCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Take backups on a schedule with systemd timers or cron.",
+	Long: `Take backups of a file on a schedule. bk schedule add writes a systemd service and timer, or a cron.d entry when
+systemd is not running, bk schedule list shows the schedules with their last run and bk schedule remove removes one.
+Every run is written to ` + scheduleLogPath + ` as a JSON line, bk check shows the last runs of a file.`,
+}
+
+var scheduleAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Schedule the backups of a file.",
+	Long: `Schedule the backups of a file, e.g. bk schedule add --file /etc/nginx/nginx.conf --every daily --keep 14.
+A run takes a backup unless the newest backup has the current content, then deletes all but the newest --keep backups.`,
+	Run: schedule_add,
+}
+
+var scheduleListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Show the scheduled backups.",
+	Long:  `Show the scheduled backups with their last run.`,
+	Run:   schedule_list,
+}
+
+var scheduleRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "Remove a scheduled backup.",
+	Long:  `Remove the systemd units or the cron.d entry of a scheduled backup. The backups are kept.`,
+	Run:   schedule_remove,
+}
+
+var scheduleRunCmd = &cobra.Command{
+	Use:    "run",
+	Short:  "Run a scheduled backup.",
+	Long:   `Run a scheduled backup, this is what the timers and cron entries of bk schedule add run.`,
+	Hidden: true,
+	Run:    schedule_run,
+}
+
+// A schedule is installed as linate-schedule-<name>.service and .timer in
+// systemdUnitDir, or as linate-schedule-<name> in cronDir.
+const (
+	schedulePrefix = "linate-schedule-"
+	cronDir        = "/etc/cron.d"
+	// scheduleLogPath keeps one scheduleRun per line
+	scheduleLogPath = "/var/log/linate/schedule.log"
+	// scheduleDescription starts the description of the units and the comment of the
+	// cron entry, the path of the file follows
+	scheduleDescription = "linate scheduled backup of "
+)
+
+// scheduleIntervals are the values of --every, the same for OnCalendar and cron.
+var scheduleIntervals = []string{"hourly", "daily", "weekly", "monthly"}
+
+// scheduleNameChars are the characters cron accepts in the name of a cron.d file.
+var scheduleNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Status of a scheduled run
+const (
+	runOK        = "ok"
+	runUnchanged = "unchanged"
+	runFailed    = "failed"
+)
+
+// scheduleRun is a line of the log of the scheduled runs.
+type scheduleRun struct {
+	Time     time.Time `json:"time"`
+	Schedule string    `json:"schedule"`
+	Source   string    `json:"source"`
+	Status   string    `json:"status"`
+	Backup   string    `json:"backup,omitempty"`
+	Deleted  int       `json:"deleted,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// schedule is an installed schedule.
+type schedule struct {
+	Name   string
+	Type   string
+	Every  string
+	Source string
+	Files  []string
+}
+
+// systemdRunning reports whether the machine was booted with systemd.
+func systemdRunning() bool {
+	return dirExists("/run/systemd/system/")
+}
+
+// scheduleNameOf returns the default name of the schedule of the file at path.
+func scheduleNameOf(path string) string {
+	return strings.Trim(scheduleNameChars.ReplaceAllString(path, "-"), "-")
+}
+
+func schedule_add(cmd *cobra.Command, args []string) {
+	loc := getBackupLocation(cmd)
+	every, _ := cmd.Flags().GetString("every")
+	keep, _ := cmd.Flags().GetInt("keep")
+	name, _ := cmd.Flags().GetString("name")
+	useCron, _ := cmd.Flags().GetBool("cron")
+	compression, _ := cmd.Flags().GetString("compress")
+	if fileExists(loc.Source()) == false {
+		exitWithError(fmt.Sprintf("File '%s' does not exist in the directory %v or follows a strict permission. Please run as the superuser if the file really exists.\n", loc.File, loc.Dir))
+	}
+	if arrContains(scheduleIntervals, every) == false {
+		exitWithError(fmt.Sprintf("Unknown interval '%s'. Available options are %s.\n", every, strings.Join(scheduleIntervals, ", ")))
+	}
+	if keep < 0 {
+		exitWithError("The number of backups to keep can not be negative.\n")
+	}
+	if compression != "" && validCompression(compression) == false {
+		exitWithError(fmt.Sprintf("Unknown compression '%s'. Available options are none, gzip and zstd.\n", compression))
+	}
+	if name == "" {
+		name = scheduleNameOf(loc.Source())
+	}
+	if scheduleNameChars.MatchString(name) {
+		exitWithError(fmt.Sprintf("Invalid schedule name '%s'. Please only use letters, digits, '-' and '_'.\n", name))
+	}
+
+	runArgs := []string{"bk", "schedule", "run", "--name", name, "--file", loc.Source()}
+	if keep > 0 {
+		runArgs = append(runArgs, "--keep", strconv.Itoa(keep))
+	}
+	if compression != "" {
+		runArgs = append(runArgs, "--compress", compression)
+	}
+	if cmd.Flags().Changed("store") {
+		runArgs = append(runArgs, "--store", getStore(cmd).Root)
+	}
+
+	// A newline would end the line of the cron entry or of the unit
+	if e := checkScheduleArgs(runArgs); e != nil {
+		exitWithError(fmt.Sprintf("Can not schedule the backup. %v\n", e))
+	}
+
+	if useCron || systemdRunning() == false {
+		if dirExists(cronDir+"/") == false {
+			exitWithError(fmt.Sprintf("Neither systemd nor cron is running, '%s' does not exist. Please install cron.\n", cronDir))
+		}
+		path := filepath.Join(cronDir, schedulePrefix+name)
+		command := linateCommandLine(runArgs, shellQuote)
+		entry := fmt.Sprintf(`# %s%s
+SHELL=/bin/sh
+PATH=/usr/sbin:/usr/bin:/sbin:/bin
+@%s root %s
+`, scheduleDescription, loc.Source(), every, command)
+		if e := writeFileAtomic(path, []byte(entry), 0644); e != nil {
+			exitWithError(fmt.Sprintf("Can not write the cron entry '%s'. Please run as the superuser. %v\n", path, e))
+		}
+		fmt.Printf("%sThe cron entry has been written to '%s'%s\n", colors["green"], path, colors["reset"])
+		return
+	}
+
+	unit := schedulePrefix + name
+	service := fmt.Sprintf(`[Unit]
+Description=%s%s
+
+[Service]
+Type=oneshot
+ExecStart=%s
+`, scheduleDescription, systemdEscape(loc.Source()), linateCommandLine(runArgs, systemdQuote))
+	timer := fmt.Sprintf(`[Unit]
+Description=%s%s
+
+[Timer]
+OnCalendar=%s
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`, scheduleDescription, systemdEscape(loc.Source()), every)
+	path, e := installSystemdUnit(unit+".service", service)
+	if e == nil {
+		path, e = installSystemdUnit(unit+".timer", timer)
+	}
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not write the unit file '%s'. Please run as the superuser. %v\n", path, e))
+	}
+	fmt.Printf("%sThe systemd timer has been written to '%s'%s\n", colors["green"], path, colors["reset"])
+	fmt.Printf("Run 'systemctl daemon-reload && systemctl enable --now %s.timer' to start it.\n", unit)
+}
+
+// checkScheduleArgs returns an error when an argument of the scheduled command has a
+// control character, none can be written to a cron entry or a unit.
+func checkScheduleArgs(args []string) error {
+	for _, arg := range args {
+		if strings.ContainsFunc(arg, unicode.IsControl) {
+			return fmt.Errorf("%s has a control character, please rename it", strconv.Quote(arg))
+		}
+	}
+	return nil
+}
+
+// readScheduleFile returns the source and the interval written by schedule_add to a
+// timer or a cron entry.
+func readScheduleFile(path string) (string, string) {
+	f, e := os.Open(path)
+	if e != nil {
+		return "", ""
+	}
+	defer f.Close()
+	source, every := "", ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if _, after, ok := strings.Cut(line, scheduleDescription); ok {
+			source = after
+			if strings.HasPrefix(line, "Description=") {
+				source = strings.ReplaceAll(source, "%%", "%")
+			}
+		} else if value, ok := strings.CutPrefix(line, "OnCalendar="); ok {
+			every = value
+		} else if strings.HasPrefix(line, "@") {
+			every = strings.TrimPrefix(strings.Fields(line)[0], "@")
+		}
+	}
+	return source, every
+}
+
+// listSchedules returns the installed schedules, sorted by name.
+func listSchedules() []schedule {
+	var schedules []schedule
+	timers, _ := filepath.Glob(filepath.Join(systemdUnitDir, schedulePrefix+"*.timer"))
+	for _, path := range timers {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), schedulePrefix), ".timer")
+		source, every := readScheduleFile(path)
+		files := []string{path}
+		if service := strings.TrimSuffix(path, ".timer") + ".service"; fileExists(service) {
+			files = append(files, service)
+		}
+		schedules = append(schedules, schedule{Name: name, Type: "systemd", Every: every, Source: source, Files: files})
+	}
+	entries, _ := filepath.Glob(filepath.Join(cronDir, schedulePrefix+"*"))
+	for _, path := range entries {
+		source, every := readScheduleFile(path)
+		schedules = append(schedules, schedule{Name: strings.TrimPrefix(filepath.Base(path), schedulePrefix), Type: "cron", Every: every, Source: source, Files: []string{path}})
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Name < schedules[j].Name
+	})
+	return schedules
+}
+
+func schedule_list(cmd *cobra.Command, args []string) {
+	schedules := listSchedules()
+	if len(schedules) == 0 {
+		fmt.Printf("No schedule found\n")
+		return
+	}
+	runs, e := readScheduleRuns()
+	if e != nil {
+		fmt.Printf("%sCan not read the log of the scheduled runs '%s'. %v%s\n", colors["yellow"], scheduleLogPath, e, colors["reset"])
+	}
+	last := map[string]scheduleRun{}
+	for _, r := range runs {
+		last[r.Schedule] = r
+	}
+
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+	tbl := table.New("Name", "File", "Every", "Type", "Last Run", "Status")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	for _, s := range schedules {
+		lastRun, status := "-", "-"
+		if r, ok := last[s.Name]; ok {
+			tm := r.Time.Local()
+			lastRun = fmt.Sprintf("%v-%v-%v | %v:%v", tm.Year(), tm.Month(), tm.Day(), tm.Hour(), tm.Minute())
+			status = r.Status
+		}
+		tbl.AddRow(s.Name, s.Source, s.Every, s.Type, lastRun, status)
+	}
+	tbl.Print()
+}
+
+func schedule_remove(cmd *cobra.Command, args []string) {
+	name, _ := cmd.Flags().GetString("name")
+	if name == "" {
+		name = scheduleNameOf(getBackupLocation(cmd).Source())
+	}
+	var found *schedule
+	for _, s := range listSchedules() {
+		if s.Name == name {
+			found = &s
+			break
+		}
+	}
+	if found == nil {
+		exitWithError(fmt.Sprintf("Schedule '%s' does not exist. bk schedule list shows the schedules.\n", name))
+	}
+	// The link of systemctl enable
+	wants := filepath.Join(systemdUnitDir, "timers.target.wants", schedulePrefix+name+".timer")
+	if _, e := os.Lstat(wants); e == nil {
+		found.Files = append(found.Files, wants)
+	}
+	for _, path := range found.Files {
+		if e := os.Remove(path); e != nil && !os.IsNotExist(e) {
+			exitWithError(fmt.Sprintf("Can not remove '%s'. Please run as the superuser. %v\n", path, e))
+		}
+		fmt.Printf("%s'%s' has been removed%s\n", colors["green"], path, colors["reset"])
+	}
+	if found.Type == "systemd" {
+		fmt.Printf("Run 'systemctl stop %s%s.timer && systemctl daemon-reload' to stop it.\n", schedulePrefix, name)
+	}
+}
+
+func schedule_run(cmd *cobra.Command, args []string) {
+	name, _ := cmd.Flags().GetString("name")
+	path, _ := cmd.Flags().GetString("file")
+	keep, _ := cmd.Flags().GetInt("keep")
+	compression, _ := cmd.Flags().GetString("compress")
+	store := getStore(cmd)
+	run := scheduleRun{Time: time.Now(), Schedule: name, Source: path}
+
+	e := runSchedule(&run, store, keep, compression)
+	if e != nil {
+		run.Status = runFailed
+		run.Error = e.Error()
+	}
+	if e := appendScheduleRun(run); e != nil {
+		fmt.Printf("%sCan not write the log of the scheduled runs '%s'. %v%s\n", colors["yellow"], scheduleLogPath, e, colors["reset"])
+	}
+	if run.Status == runFailed {
+		exitWithError(fmt.Sprintf("%sThe scheduled backup of '%s' failed. %s%s\n", colors["red"], path, run.Error, colors["reset"]))
+	}
+}
+
+// runSchedule takes the backup of a scheduled run and applies --keep, run gets the
+// outcome.
+func runSchedule(run *scheduleRun, store *backupStore, keep int, compression string) error {
+	if fileExists(run.Source) == false {
+		return fmt.Errorf("file '%s' does not exist", run.Source)
+	}
+	loc := locationOf(run.Source, store)
+	run.Status = runUnchanged
+	if backedUp(loc) == false {
+		opts := defaultOptions(store)
+		if compression != "" {
+			opts.Compression = compression
+		}
+		opts.Recursive = dirExists(run.Source + "/")
+		opts.Note = "scheduled by " + run.Schedule
+		backup, lost, e := createBackup(loc, opts)
+		if e != nil {
+			return e
+		}
+		fmt.Printf("%slinate successfully created a backup file '%s'%s\n", colors["green"], backup, colors["reset"])
+		printLostMetadata(lost)
+		run.Status = runOK
+		run.Backup = backup
+	}
+	if keep == 0 {
+		return nil
+	}
+	backups, e := loc.list()
+	if e != nil {
+		return e
+	}
+	forgotten := retentionPolicy{KeepLast: keep}.forget(map[string][]backupFile{run.Source: backups})
+	failed := deleteBackups(forgotten, store)
+	run.Deleted = len(forgotten) - failed
+	if failed < len(forgotten) {
+		collectChunks(store)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d old backup(s) could not be deleted", failed)
+	}
+	return nil
+}
+
+// appendScheduleRun adds a run to the log of the scheduled runs.
+func appendScheduleRun(run scheduleRun) error {
+	if e := os.MkdirAll(filepath.Dir(scheduleLogPath), 0755); e != nil {
+		return e
+	}
+	line, e := json.Marshal(run)
+	if e != nil {
+		return e
+	}
+	f, e := os.OpenFile(scheduleLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if e != nil {
+		return e
+	}
+	// One write per line, so runs at the same time do not mix their lines
+	if _, e = f.Write(append(line, '\n')); e != nil {
+		f.Close()
+		return e
+	}
+	return f.Close()
+}
+
+// readScheduleRuns returns the logged runs, oldest first. Lines that can not be
+// parsed are skipped.
+func readScheduleRuns() ([]scheduleRun, error) {
+	f, e := os.Open(scheduleLogPath)
+	if os.IsNotExist(e) {
+		return nil, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	var runs []scheduleRun
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r scheduleRun
+		if json.Unmarshal(scanner.Bytes(), &r) == nil {
+			runs = append(runs, r)
+		}
+	}
+	return runs, scanner.Err()
+}
+
+// printScheduleRuns prints the last scheduled runs of the file at source, for bk
+// check.
+func printScheduleRuns(source string) {
+	runs, e := readScheduleRuns()
+	if e != nil {
+		return
+	}
+	var mine []scheduleRun
+	for _, r := range runs {
+		if r.Source == source {
+			mine = append(mine, r)
+		}
+	}
+	if len(mine) == 0 {
+		return
+	}
+	if len(mine) > 5 {
+		mine = mine[len(mine)-5:]
+	}
+	fmt.Printf("\nLast scheduled runs:\n")
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+	tbl := table.New("Date | Time", "Schedule", "Status", "Details")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	for i := len(mine) - 1; i >= 0; i-- {
+		r := mine[i]
+		tm := r.Time.Local()
+		var details []string
+		if r.Backup != "" {
+			details = append(details, filepath.Base(r.Backup))
+		}
+		if r.Deleted > 0 {
+			details = append(details, fmt.Sprintf("%d old backup(s) deleted", r.Deleted))
+		}
+		if r.Error != "" {
+			details = append(details, r.Error)
+		}
+		tbl.AddRow(fmt.Sprintf("%v-%v-%v | %v:%v", tm.Year(), tm.Month(), tm.Day(), tm.Hour(), tm.Minute()), r.Schedule, r.Status, strings.Join(details, ", "))
+	}
+	tbl.Print()
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckScheduleArgs(t *testing.T) {
+	for _, source := range []string{"/etc/a\n@hourly root id", "/etc/a\r", "/etc/a\x00b", "/etc/\x1b[0m"} {
+		if e := checkScheduleArgs([]string{"bk", "schedule", "run", "--file", source}); e == nil {
+			t.Errorf("checkScheduleArgs accepts %q", source)
+		}
+	}
+	if e := checkScheduleArgs([]string{"--file", "/srv/it's 100% $HOME `id`.conf"}); e != nil {
+		t.Errorf("checkScheduleArgs = %v, want nil", e)
+	}
+}
+
+func TestReadScheduleFileEscaped(t *testing.T) {
+	source := "/srv/100%d.conf"
+	timer := filepath.Join(t.TempDir(), "linate-schedule-srv.timer")
+	content := fmt.Sprintf("[Unit]\nDescription=%s%s\n\n[Timer]\nOnCalendar=daily\n", scheduleDescription, systemdEscape(source))
+	if e := os.WriteFile(timer, []byte(content), 0644); e != nil {
+		t.Fatal(e)
+	}
+	if got, every := readScheduleFile(timer); got != source || every != "daily" {
+		t.Errorf("readScheduleFile = %q, %q, want %q, daily", got, every, source)
+	}
+	if systemdEscape(source) != "/srv/100%%d.conf" {
+		t.Errorf("systemdEscape(%q) = %q", source, systemdEscape(source))
+	}
+}
@@ -0,0 +1,378 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// A backup store is a directory that keeps backups away from the original files.
+// The directory tree of the original files is mirrored inside it, so the backups
+// of /etc/nginx/nginx.conf are kept in <store>/etc/nginx/, and manifest.json in the
+// root of the store indexes every backup.
+const manifestName = "manifest.json"
+
+// Backups kept next to the files are indexed by a hidden manifest in the same
+// directory, so bk verify can check them as well.
+const sidecarName = ".linate-manifest.json"
+
+// manifestRecord describes one backup in the manifest. Path is relative to the root
+// of the store so the store can be moved.
+type manifestRecord struct {
+	Path     string    `json:"path"`
+	Source   string    `json:"source"`
+	Time     time.Time `json:"time"`
+	Size     int64     `json:"size"`
+	Checksum string    `json:"checksum"`
+	// ModTime is the modification time of the backup file when it was taken
+	ModTime time.Time `json:"mtime"`
+	// StoredChecksum is the sha256 of an encrypted backup file as it is on the disk
+	StoredChecksum string `json:"stored_checksum,omitempty"`
+	User           string `json:"user"`
+	// Note and Tags are given with bk take --note and --tag
+	Note string   `json:"note,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+	// Profile and Set tell the profile set the backup belongs to
+	Profile string `json:"profile,omitempty"`
+	Set     string `json:"set,omitempty"`
+	// Metadata is the metadata of a backup kept in a target, see targetSession
+	Metadata *fileMetadata `json:"metadata,omitempty"`
+}
+
+type manifest struct {
+	Version int              `json:"version"`
+	Backups []manifestRecord `json:"backups"`
+}
+
+type backupStore struct {
+	Root string
+	// Sidecar is set for the hidden manifest of a directory with backups kept next
+	// to the files, there is no mirrored tree then
+	Sidecar bool
+}
+
+// sidecarOf returns the hidden manifest of the backups kept in dir.
+func sidecarOf(dir string) *backupStore {
+	return &backupStore{Root: filepath.Clean(dir), Sidecar: true}
+}
+
+func (s *backupStore) manifestPath() string {
+	if s.Sidecar {
+		return filepath.Join(s.Root, sidecarName)
+	}
+	return filepath.Join(s.Root, manifestName)
+}
+
+// dirFor returns the directory of the store that keeps the backups of the files in
+// dir, with a trailing slash.
+func (s *backupStore) dirFor(dir string) string {
+	return filepath.Join(s.Root, dir) + "/"
+}
+
+// relPath returns path relative to the root of the store.
+func (s *backupStore) relPath(path string) string {
+	rel, e := filepath.Rel(s.Root, path)
+	if e != nil {
+		return path
+	}
+	return rel
+}
+
+func (s *backupStore) loadManifest() (*manifest, error) {
+	m := &manifest{Version: 1}
+	data, e := os.ReadFile(s.manifestPath())
+	if os.IsNotExist(e) {
+		return m, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	if e = json.Unmarshal(data, m); e != nil {
+		return nil, fmt.Errorf("invalid manifest '%s': %v", s.manifestPath(), e)
+	}
+	return m, nil
+}
+
+func (s *backupStore) saveManifest(m *manifest) error {
+	sort.Slice(m.Backups, func(i, j int) bool {
+		return m.Backups[i].Path < m.Backups[j].Path
+	})
+	data, e := json.MarshalIndent(m, "", "  ")
+	if e != nil {
+		return e
+	}
+	return writeFileAtomic(s.manifestPath(), append(data, '\n'), 0600)
+}
+
+// recordedPaths returns the paths of every backup in the manifest.
+func (s *backupStore) recordedPaths() (map[string]bool, error) {
+	m, e := s.loadManifest()
+	if e != nil {
+		return nil, e
+	}
+	paths := map[string]bool{}
+	for _, r := range m.Backups {
+		paths[filepath.Join(s.Root, r.Path)] = true
+	}
+	return paths, nil
+}
+
+// updateManifest changes the manifest with update while holding the lock of the
+// store, so changes of other linate processes are not lost.
+func (s *backupStore) updateManifest(update func(m *manifest) bool) error {
+	lock, e := lockDir(s.Root, -1)
+	if e != nil {
+		return e
+	}
+	defer lock.unlock()
+	m, e := s.loadManifest()
+	if e != nil {
+		return e
+	}
+	if update(m) == false {
+		return nil
+	}
+	return s.saveManifest(m)
+}
+
+// addRecord adds a backup to the manifest.
+func (s *backupStore) addRecord(r manifestRecord) error {
+	return s.updateManifest(func(m *manifest) bool {
+		m.Backups = append(m.Backups, r)
+		return true
+	})
+}
+
+// removeRecord removes the backup at path from the manifest.
+func (s *backupStore) removeRecord(path string) error {
+	rel := s.relPath(path)
+	return s.updateManifest(func(m *manifest) bool {
+		for i := range m.Backups {
+			if m.Backups[i].Path == rel {
+				m.Backups = append(m.Backups[:i], m.Backups[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// renameRecord changes the path of the backup at oldPath in the manifest.
+func (s *backupStore) renameRecord(oldPath string, newPath string) error {
+	rel := s.relPath(oldPath)
+	return s.updateManifest(func(m *manifest) bool {
+		for i := range m.Backups {
+			if m.Backups[i].Path == rel {
+				m.Backups[i].Path = s.relPath(newPath)
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// backupLocation tells where the backups of a file are kept.
+type backupLocation struct {
+	// Dir is the directory of the original file, with a trailing slash
+	Dir  string
+	File string
+	// Store is nil when the backups are kept next to the original file
+	Store *backupStore
+}
+
+func (l backupLocation) Source() string {
+	return l.Dir + l.File
+}
+
+// BackupDir returns the directory that keeps the backups, with a trailing slash.
+func (l backupLocation) BackupDir() string {
+	if l.Store != nil {
+		return l.Store.dirFor(l.Dir)
+	}
+	return l.Dir
+}
+
+// index returns the manifest that records the backups of the file, the manifest of
+// the store or the hidden one of the directory.
+func (l backupLocation) index() *backupStore {
+	if l.Store != nil {
+		return l.Store
+	}
+	return sidecarOf(l.Dir)
+}
+
+// list returns the backups of the file, newest first. The directory is scanned for
+// backups kept next to the file, the manifest is read for a store.
+func (l backupLocation) list() ([]backupFile, error) {
+	if l.Store == nil {
+		backups, e := findBackups(l.Dir, l.File)
+		if e != nil {
+			return nil, e
+		}
+		// The hidden manifest knows what the name does not tell
+		m, e := sidecarOf(l.Dir).loadManifest()
+		if e != nil {
+			return backups, nil
+		}
+		for i := range backups {
+			for j := range m.Backups {
+				if m.Backups[j].Path == backups[i].Name {
+					backups[i].Record = &m.Backups[j]
+				}
+			}
+		}
+		return backups, nil
+	}
+	m, e := l.Store.loadManifest()
+	if e != nil {
+		return nil, e
+	}
+	var backups []backupFile
+	for i := range m.Backups {
+		if m.Backups[i].Source != l.Source() {
+			continue
+		}
+		b, ok := l.Store.backupOf(&m.Backups[i])
+		if ok {
+			backups = append(backups, b)
+		}
+	}
+	sortBackups(backups)
+	return backups, nil
+}
+
+// backupOf returns the backup of a manifest record, false when its name is not a
+// backup name or the file is missing.
+func (s *backupStore) backupOf(r *manifestRecord) (backupFile, bool) {
+	path := filepath.Join(s.Root, r.Path)
+	b, ok := parseBackupName(filepath.Base(path))
+	if ok == false {
+		return backupFile{}, false
+	}
+	info, e := os.Stat(path)
+	if e != nil {
+		return backupFile{}, false
+	}
+	return backupFile{backupName: b, Dir: filepath.Dir(path) + "/", Name: filepath.Base(path), Info: info, Record: r}, true
+}
+
+// listBackupGroups returns the backups of the files in dir grouped by the path of
+// the original file, each group newest first. With a store the manifest is read,
+// and every backup of the store is returned when dir is empty.
+func listBackupGroups(dir string, store *backupStore) (map[string][]backupFile, error) {
+	groups := map[string][]backupFile{}
+	if store == nil {
+		entries, e := os.ReadDir(dir)
+		if e != nil {
+			return nil, e
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			b, ok := parseBackupName(entry.Name())
+			if ok == false {
+				continue
+			}
+			info, e := entry.Info()
+			if e != nil {
+				continue
+			}
+			groups[dir+b.File] = append(groups[dir+b.File], backupFile{backupName: b, Dir: dir, Name: entry.Name(), Info: info})
+		}
+	} else {
+		m, e := store.loadManifest()
+		if e != nil {
+			return nil, e
+		}
+		for i := range m.Backups {
+			r := &m.Backups[i]
+			if dir != "" && filepath.Dir(r.Source)+"/" != dir {
+				continue
+			}
+			b, ok := store.backupOf(r)
+			if ok {
+				groups[r.Source] = append(groups[r.Source], b)
+			}
+		}
+	}
+	for source := range groups {
+		sortBackups(groups[source])
+	}
+	return groups, nil
+}
+
+// locationOf returns the location of the backups of the file at source.
+func locationOf(source string, store *backupStore) backupLocation {
+	return backupLocation{Dir: filepath.Dir(source) + "/", File: filepath.Base(source), Store: store}
+}
+
+// remove deletes a backup and its manifest record, unless the pre_delete hook fails.
+func (l backupLocation) remove(b backupFile) error {
+	env := hookEnv{Source: b.Dir + b.File, Backup: b.Path(), Store: l.Store}
+	if b.Record != nil {
+		env.Source = b.Record.Source
+		env.Checksum = b.Record.Checksum
+	}
+	if e := runHooks(hookPreDelete, env); e != nil {
+		return e
+	}
+	e := os.Remove(b.Path())
+	if e != nil && !os.IsNotExist(e) {
+		return e
+	}
+	if l.Store != nil {
+		return l.Store.removeRecord(b.Path())
+	}
+	return sidecarOf(b.Dir).removeRecord(b.Path())
+}
+
+// addStoreFlag adds the --store flag to a bk command.
+func addStoreFlag(cmd *cobra.Command) {
+	cmd.Flags().StringP("store", "s", "", "Keep backups in this store directory instead of next to the file, e.g. /var/lib/linate/backups. Default is backup.store in the config file.")
+}
+
+// getStore returns the backup store chosen by the --store flag or the config file,
+// nil when backups are kept next to the files.
+func getStore(cmd *cobra.Command) *backupStore {
+	root, _ := cmd.Flags().GetString("store")
+	if root == "" {
+		root = getConfig().Backup.Store
+	}
+	if root == "" {
+		return nil
+	}
+	root, e := filepath.Abs(root)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Invalid store directory '%s'. %v\n", root, e))
+	}
+	return &backupStore{Root: root}
+}
+
+// getBackupLocation reads the --dir, --file and --store flags of a bk command and
+// exits when the directory does not exist.
+func getBackupLocation(cmd *cobra.Command) backupLocation {
+	dir, _ := cmd.Flags().GetString("dir")
+	if dir == "" {
+		dir = currDir
+	}
+	file, _ := cmd.Flags().GetString("file")
+
+	d := dirExists(dir)
+	if d == false {
+		exitWithError(fmt.Sprintf("Directory '%s' does not exist or follows a strict permission. Please run as the superuser if the directory really exists.\n", dir))
+	}
+	dir, _ = filepath.Abs(dir)
+
+	// Add forward slash after dir
+	if strings.HasSuffix(dir, "/") == false {
+		dir = dir + "/"
+	}
+	return backupLocation{Dir: dir, File: file, Store: getStore(cmd)}
+}
@@ -0,0 +1,313 @@
+package cmd
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// fileMetadata is the metadata of a backup file kept in a target, which may not
+// keep it itself, like S3. It is applied to the file when it is downloaded.
+type fileMetadata struct {
+	Mode       int64             `json:"mode"`
+	Uid        int               `json:"uid"`
+	Gid        int               `json:"gid"`
+	Uname      string            `json:"uname,omitempty"`
+	Gname      string            `json:"gname,omitempty"`
+	ModTime    time.Time         `json:"mtime"`
+	AccessTime time.Time         `json:"atime"`
+	Xattrs     map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// metadataOf returns the metadata of the file at path.
+func metadataOf(path string) (*fileMetadata, error) {
+	info, e := os.Lstat(path)
+	if e != nil {
+		return nil, e
+	}
+	hdr, e := fileHeader(path, filepath.Base(path), info)
+	if e != nil {
+		return nil, e
+	}
+	m := &fileMetadata{Mode: hdr.Mode, Uid: hdr.Uid, Gid: hdr.Gid, Uname: hdr.Uname, Gname: hdr.Gname, ModTime: hdr.ModTime, AccessTime: hdr.AccessTime}
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, xattrPAXPrefix); ok {
+			if m.Xattrs == nil {
+				m.Xattrs = map[string][]byte{}
+			}
+			m.Xattrs[name] = []byte(value)
+		}
+	}
+	return m, nil
+}
+
+// apply sets the metadata on the file at path and returns what could not be kept.
+func (m *fileMetadata) apply(path string) []string {
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: filepath.Base(path), Mode: m.Mode, Uid: m.Uid, Gid: m.Gid, ModTime: m.ModTime, AccessTime: m.AccessTime}
+	for name, value := range m.Xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[xattrPAXPrefix+name] = string(value)
+	}
+	return applyHeader(path, hdr)
+}
+
+// targetSession mirrors a target in a local staging store for one bk command. The
+// manifest, and the backups of the file the command works on, are downloaded to
+// the staging store, the command works on it like on any store, and the backups it
+// took are uploaded when it is done.
+type targetSession struct {
+	target  backupTarget
+	staging *backupStore
+	// remote holds the paths of the backups the target has
+	remote map[string]bool
+	// stop cancels the removal of the staging store on an exit or interrupt
+	stop   []func()
+	closed bool
+}
+
+// addTargetFlag adds the --target flag to a bk command.
+func addTargetFlag(cmd *cobra.Command) {
+	cmd.Flags().StringP("target", "t", "", "Keep backups in a remote target instead of next to the file: s3://bucket/prefix, sftp://user@host/path or a directory.")
+	cmd.MarkFlagsMutuallyExclusive("store", "target")
+}
+
+// getTargetSession opens the target of the --target flag and downloads its
+// manifest, nil without the flag. The caller uses the staging store as the store
+// of its location and calls finish at the end.
+func getTargetSession(cmd *cobra.Command) *targetSession {
+	raw, _ := cmd.Flags().GetString("target")
+	if raw == "" {
+		return nil
+	}
+	s, e := openTargetSession(raw)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not open the target '%s'. %v\n", raw, e))
+	}
+	return s
+}
+
+// openTargetSession opens the target raw and downloads its manifest to a new
+// staging store.
+func openTargetSession(raw string) (*targetSession, error) {
+	target, e := openTarget(raw)
+	if e != nil {
+		return nil, e
+	}
+	dir, e := os.MkdirTemp("", "linate-target-")
+	if e != nil {
+		target.Close()
+		return nil, e
+	}
+	s := &targetSession{target: target, staging: &backupStore{Root: dir}, remote: map[string]bool{}}
+	// The staging store can hold decrypted backups, it does not outlive linate
+	s.stop = []func(){removeOnInterrupt(dir), onErrorExit(s.close)}
+	if e = s.download(); e != nil {
+		s.close()
+		return nil, fmt.Errorf("can not read the manifest: %v", e)
+	}
+	return s, nil
+}
+
+// download replaces the manifest of the staging store with the one of the target.
+func (s *targetSession) download() error {
+	e := s.target.Get(manifestName, s.staging.manifestPath())
+	if errors.Is(e, fs.ErrNotExist) {
+		os.Remove(s.staging.manifestPath())
+	} else if e != nil {
+		return e
+	}
+	m, e := s.staging.loadManifest()
+	if e != nil {
+		return e
+	}
+	for _, r := range m.Backups {
+		s.remote[r.Path] = true
+	}
+	return nil
+}
+
+// targetLockName is created on the target while a linate uploads, so the manifest
+// is changed by one at a time.
+const targetLockName = manifestName + ".lock"
+
+// targetLockWait is how long push waits for the lock of another linate.
+var targetLockWait = time.Minute
+
+// lock creates the lock of the target, it waits for another linate holding it at
+// most targetLockWait.
+func (s *targetSession) lock() error {
+	host, _ := os.Hostname()
+	owner := filepath.Join(s.staging.Root, ".linate-lock")
+	content := fmt.Sprintf("%s %d %s\n", host, os.Getpid(), time.Now().Format(time.RFC3339))
+	if e := os.WriteFile(owner, []byte(content), 0600); e != nil {
+		return e
+	}
+	defer os.Remove(owner)
+	start := time.Now()
+	waiting := false
+	for {
+		e := s.target.Create(targetLockName, owner)
+		if errors.Is(e, fs.ErrExist) == false {
+			return e
+		}
+		if time.Since(start) >= targetLockWait {
+			return fmt.Errorf("another linate has been uploading for longer than %v, remove '%s' of the target if none is running", targetLockWait, targetLockName)
+		}
+		if waiting == false {
+			fmt.Printf("%sWaiting for another linate uploading to '%s'%s\n", colors["yellow"], s.target, colors["reset"])
+			waiting = true
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (s *targetSession) unlock() {
+	s.target.Remove(targetLockName)
+}
+
+// fetch downloads the backups of the file at source to the staging store. Backups
+// missing on the target are left out, like missing backups of a store.
+func (s *targetSession) fetch(source string) error {
+	m, e := s.staging.loadManifest()
+	if e != nil {
+		return e
+	}
+	for _, r := range m.Backups {
+		if r.Source != source {
+			continue
+		}
+		dst := filepath.Join(s.staging.Root, r.Path)
+		if e = os.MkdirAll(filepath.Dir(dst), 0700); e != nil {
+			return e
+		}
+		e = s.target.Get(filepath.ToSlash(r.Path), dst)
+		if errors.Is(e, fs.ErrNotExist) {
+			continue
+		}
+		if e != nil {
+			return fmt.Errorf("can not download '%s': %v", r.Path, e)
+		}
+		if r.Metadata != nil {
+			r.Metadata.apply(dst)
+		}
+	}
+	return nil
+}
+
+// remotePath returns where the backup at path of the staging store is on the target.
+func (s *targetSession) remotePath(path string) string {
+	return strings.TrimSuffix(s.target.String(), "/") + "/" + filepath.ToSlash(s.staging.relPath(path))
+}
+
+// push uploads the backups taken in the staging store, then the manifest. It
+// returns the paths of the uploaded backups on the target.
+func (s *targetSession) push() ([]string, error) {
+	m, e := s.staging.loadManifest()
+	if e != nil {
+		return nil, e
+	}
+	var taken []manifestRecord
+	for _, r := range m.Backups {
+		if s.remote[r.Path] == false {
+			taken = append(taken, r)
+		}
+	}
+	if len(taken) == 0 {
+		return nil, nil
+	}
+	if e = s.lock(); e != nil {
+		return nil, e
+	}
+	defer s.unlock()
+	// Another linate may have uploaded meanwhile, its backups stay in the manifest
+	if e = s.download(); e != nil {
+		return nil, fmt.Errorf("can not read the manifest: %v", e)
+	}
+	m, e = s.staging.loadManifest()
+	if e != nil {
+		return nil, e
+	}
+
+	var uploaded []string
+	for _, r := range taken {
+		path := filepath.Join(s.staging.Root, r.Path)
+		b, ok := parseBackupName(filepath.Base(path))
+		for ok {
+			name := filepath.Join(filepath.Dir(r.Path), b.String())
+			exists, e := s.target.Exists(filepath.ToSlash(name))
+			if e != nil {
+				return uploaded, e
+			}
+			if s.remote[name] == false && exists == false {
+				break
+			}
+			b.Serial += 1
+		}
+		if ok && b.String() != filepath.Base(path) {
+			renamed := filepath.Join(filepath.Dir(path), b.String())
+			if e = os.Rename(path, renamed); e != nil {
+				return uploaded, e
+			}
+			path = renamed
+			r.Path = s.staging.relPath(path)
+		}
+		if r.Metadata, e = metadataOf(path); e != nil {
+			return uploaded, e
+		}
+		if e = s.target.Put(filepath.ToSlash(r.Path), path); e != nil {
+			return uploaded, fmt.Errorf("can not upload '%s': %v", r.Path, e)
+		}
+		s.remote[r.Path] = true
+		m.Backups = append(m.Backups, r)
+		uploaded = append(uploaded, s.remotePath(path))
+	}
+	if e = s.staging.saveManifest(m); e != nil {
+		return uploaded, e
+	}
+	return uploaded, s.target.Put(manifestName, s.staging.manifestPath())
+}
+
+// finish uploads what the command took and removes the staging store. When the
+// upload fails the staging store is kept and linate exits.
+func (s *targetSession) finish() {
+	if s == nil {
+		return
+	}
+	uploaded, e := s.push()
+	for _, path := range uploaded {
+		fmt.Printf("%s'%s' has been uploaded%s\n", colors["green"], path, colors["reset"])
+	}
+	if e != nil {
+		s.keep()
+		exitWithError(fmt.Sprintf("%sCan not upload the backups to the target '%s', they are kept in '%s'. %v%s\n", colors["red"], s.target, s.staging.Root, e, colors["reset"]))
+	}
+	s.close()
+}
+
+// close removes the staging store without uploading anything.
+func (s *targetSession) close() {
+	s.keep()
+	os.RemoveAll(s.staging.Root)
+}
+
+// keep closes the target and keeps the staging store, for the backups that could
+// not be uploaded.
+func (s *targetSession) keep() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for _, stop := range s.stop {
+		stop()
+	}
+	s.target.Close()
+}
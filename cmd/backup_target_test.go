@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// takeToTarget takes a backup of source in a new session of the target at root
+// and pushes it.
+func takeToTarget(t *testing.T, root string, source string, taken time.Time) []string {
+	t.Helper()
+	s, e := openTargetSession(root)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.close()
+	opts := backupOptions{Time: taken}
+	if _, _, e = createBackup(locationOf(source, s.staging), opts); e != nil {
+		t.Fatal(e)
+	}
+	uploaded, e := s.push()
+	if e != nil {
+		t.Fatal(e)
+	}
+	return uploaded
+}
+
+// setupTarget returns a file to back up and the root of an empty local target.
+func setupTarget(t *testing.T) (string, string) {
+	t.Helper()
+	loadedConfig = &linateConfig{}
+	dir := t.TempDir()
+	source := filepath.Join(dir, "my-app.conf")
+	if e := os.WriteFile(source, []byte("listen 80\n"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	root := filepath.Join(dir, "target")
+	if e := os.Mkdir(root, 0700); e != nil {
+		t.Fatal(e)
+	}
+	return source, root
+}
+
+func loadTargetManifest(t *testing.T, root string) *manifest {
+	t.Helper()
+	m, e := (&backupStore{Root: root}).loadManifest()
+	if e != nil {
+		t.Fatal(e)
+	}
+	return m
+}
+
+func TestTargetPush(t *testing.T) {
+	source, root := setupTarget(t)
+	taken := time.Date(2025, time.May, 3, 14, 25, 30, 0, time.Local)
+
+	uploaded := takeToTarget(t, root, source, taken)
+	if len(uploaded) != 1 {
+		t.Fatalf("uploaded %v, want one backup", uploaded)
+	}
+	// The same second again, the name is in the manifest of the target
+	takeToTarget(t, root, source, taken)
+
+	m := loadTargetManifest(t, root)
+	if len(m.Backups) != 2 {
+		t.Fatalf("the manifest has %d backups, want 2", len(m.Backups))
+	}
+	for _, name := range []string{"my-app.conf-20250503T142530-1", "my-app.conf-20250503T142530-2"} {
+		path := filepath.Join(root, filepath.Dir(source), name)
+		data, e := os.ReadFile(path)
+		if e != nil {
+			t.Fatalf("backup %s is not in the target: %v", name, e)
+		}
+		if string(data) != "listen 80\n" {
+			t.Errorf("backup %s has %q", name, data)
+		}
+	}
+	for _, r := range m.Backups {
+		if r.Metadata == nil {
+			t.Errorf("backup %s has no metadata", r.Path)
+		}
+	}
+	if _, e := os.Stat(filepath.Join(root, targetLockName)); os.IsNotExist(e) == false {
+		t.Errorf("the lock of the target is left behind: %v", e)
+	}
+}
+
+func TestTargetPushConcurrent(t *testing.T) {
+	source, root := setupTarget(t)
+	taken := time.Date(2025, time.May, 3, 14, 25, 30, 0, time.Local)
+
+	// Both sessions read the manifest before either uploads
+	var sessions []*targetSession
+	for i := 0; i < 2; i++ {
+		s, e := openTargetSession(root)
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer s.close()
+		if _, _, e = createBackup(locationOf(source, s.staging), backupOptions{Time: taken}); e != nil {
+			t.Fatal(e)
+		}
+		sessions = append(sessions, s)
+	}
+	for _, s := range sessions {
+		if _, e := s.push(); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	m := loadTargetManifest(t, root)
+	if len(m.Backups) != 2 {
+		t.Fatalf("the manifest has %d backups, want 2", len(m.Backups))
+	}
+	if m.Backups[0].Path == m.Backups[1].Path {
+		t.Errorf("both backups are %s", m.Backups[0].Path)
+	}
+}
+
+func TestTargetFetch(t *testing.T) {
+	source, root := setupTarget(t)
+	takeToTarget(t, root, source, time.Date(2025, time.May, 3, 14, 25, 30, 0, time.Local))
+	takeToTarget(t, root, source, time.Date(2025, time.May, 4, 8, 0, 0, 0, time.Local))
+
+	s, e := openTargetSession(root)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.close()
+	if e = s.fetch(source); e != nil {
+		t.Fatal(e)
+	}
+	backups, e := locationOf(source, s.staging).list()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("fetched %d backups, want 2", len(backups))
+	}
+	if backups[0].Name != "my-app.conf-20250504T080000-1" {
+		t.Errorf("the newest backup is %s", backups[0].Name)
+	}
+	if backups[0].Info.Mode().Perm() != 0644 {
+		t.Errorf("the mode of the backup is %v, want 0644", backups[0].Info.Mode().Perm())
+	}
+	// Nothing was taken, nothing is uploaded
+	if uploaded, e := s.push(); e != nil || len(uploaded) != 0 {
+		t.Errorf("push = %v, %v, want nothing", uploaded, e)
+	}
+}
+
+func TestTargetLocked(t *testing.T) {
+	source, root := setupTarget(t)
+	if e := os.WriteFile(filepath.Join(root, targetLockName), []byte("other\n"), 0600); e != nil {
+		t.Fatal(e)
+	}
+	wait := targetLockWait
+	targetLockWait = 0
+	defer func() { targetLockWait = wait }()
+
+	s, e := openTargetSession(root)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.close()
+	if _, _, e = createBackup(locationOf(source, s.staging), backupOptions{}); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = s.push(); e == nil {
+		t.Fatal("push succeeded while the target is locked")
+	}
+	if m := loadTargetManifest(t, root); len(m.Backups) != 0 {
+		t.Errorf("the manifest has %d backups, want none", len(m.Backups))
+	}
+	if _, e := os.Stat(filepath.Join(root, targetLockName)); e != nil {
+		t.Errorf("the lock of the other linate is removed: %v", e)
+	}
+}
+
+func TestTargetExitRemovesStaging(t *testing.T) {
+	if root := os.Getenv("LINATE_TEST_TARGET"); root != "" {
+		// Run by the test below, exits like a failing bk restore
+		loadedConfig = &linateConfig{}
+		s, e := openTargetSession(root)
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer s.finish()
+		exitWithError("failed\n")
+	}
+	source, root := setupTarget(t)
+	takeToTarget(t, root, source, time.Date(2025, time.May, 3, 14, 25, 30, 0, time.Local))
+
+	tmp := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestTargetExitRemovesStaging$")
+	cmd.Env = append(os.Environ(), "LINATE_TEST_TARGET="+root, "TMPDIR="+tmp)
+	if out, e := cmd.CombinedOutput(); e == nil {
+		t.Fatalf("the session did not exit:\n%s", out)
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf("the staging store is left behind: %v", entries)
+	}
+	if _, e := os.Stat(filepath.Join(root, targetLockName)); os.IsNotExist(e) == false {
+		t.Errorf("the lock of the target is left behind: %v", e)
+	}
+}
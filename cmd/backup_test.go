@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateBackupHooksUnlocked(t *testing.T) {
+	if _, e := exec.LookPath("flock"); e != nil {
+		t.Skip("flock is not installed")
+	}
+	dir := t.TempDir() + "/"
+	source := filepath.Join(dir, "db.conf")
+	if e := os.WriteFile(source, []byte("port 5432\n"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	// The hooks fail when they can not lock the directory, like a bk take in a hook
+	loadedConfig = &linateConfig{}
+	loadedConfig.Backup.Hooks.PreTake = []string{`flock -n "$(dirname "$LINATE_SOURCE")" true`}
+	loadedConfig.Backup.Hooks.PostTake = []string{`flock -n "$(dirname "$LINATE_SOURCE")" touch "$LINATE_BACKUP.post"`}
+	defer func() { loadedConfig = &linateConfig{} }()
+
+	path, _, e := createBackup(locationOf(source, nil), backupOptions{})
+	if e != nil {
+		t.Fatalf("the pre_take hook runs under the lock: %v", e)
+	}
+	if _, e = os.Stat(path + ".post"); e != nil {
+		t.Errorf("the post_take hook runs under the lock: %v", e)
+	}
+}
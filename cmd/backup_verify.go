@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	backUpCmd.AddCommand(verifyBackupCmd)
+	verifyBackupCmd.Flags().StringP("dir", "d", "", "Enter the directory of the file, absolute directory not relative.")
+	verifyBackupCmd.Flags().StringP("file", "f", "", "Enter the filename. Without it every backup in the directory is verified.")
+	verifyBackupCmd.Flags().Bool("all", false, "Verify every backup of the backup store.")
+	addStoreFlag(verifyBackupCmd)
+	verifyBackupCmd.MarkFlagsMutuallyExclusive("file", "all")
+}
+
+var verifyBackupCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check that backups have not changed since they were taken.",
+	Long: `Check that backups have not changed since they were taken. bk take records the sha256 checksum, size and
+modification time of every backup, in the manifest of the backup store or in a hidden .linate-manifest.json next to
+the backups. bk verify reads every backup again and reports it as OK, MODIFIED or MISSING. Backups taken before
+checksums were recorded are reported as UNRECORDED. The exit status is 1 if a backup is modified or missing.`,
+	Run: verify_backup,
+}
+
+const (
+	verifyOK         = "OK"
+	verifyModified   = "MODIFIED"
+	verifyMissing    = "MISSING"
+	verifyUnrecorded = "UNRECORDED"
+)
+
+var verifyColors = map[string]string{
+	verifyOK:         "green",
+	verifyModified:   "red",
+	verifyMissing:    "red",
+	verifyUnrecorded: "yellow",
+}
+
+// verifyRecord reads a backup again and compares it with its manifest record. It
+// returns the status and what changed.
+func verifyRecord(index *backupStore, r manifestRecord) (string, string) {
+	path := filepath.Join(index.Root, r.Path)
+	info, e := os.Stat(path)
+	if os.IsNotExist(e) {
+		return verifyMissing, ""
+	}
+	if e != nil {
+		return verifyMissing, e.Error()
+	}
+	_, encrypted := splitEncoding(encodingOf(path))
+	if encrypted && r.StoredChecksum != "" && canDecrypt() == false {
+		return verifyStored(path, r)
+	}
+	sum, e := hashFile(path, encodingOf(path))
+	if encrypted && r.StoredChecksum != "" && errors.Is(e, errWrongKey) {
+		return verifyStored(path, r)
+	}
+	if e != nil {
+		return verifyModified, fmt.Sprintf("can not be read: %v", e)
+	}
+	if sum != r.Checksum {
+		return verifyModified, fmt.Sprintf("sha256 %s, was %s", sum, r.Checksum)
+	}
+	if size, e := originalSize(path, info); e == nil && r.Size != 0 && size != r.Size {
+		return verifyModified, fmt.Sprintf("size %d byte, was %d byte", size, r.Size)
+	}
+	if r.ModTime.IsZero() == false && info.ModTime().Equal(r.ModTime) == false {
+		return verifyOK, fmt.Sprintf("content unchanged, modification time changed to %s", info.ModTime().Format("2006-01-02 15:04:05"))
+	}
+	return verifyOK, ""
+}
+
+// verifyStored compares an encrypted backup file with its record without decrypting
+// it, when there is no key for it.
+func verifyStored(path string, r manifestRecord) (string, string) {
+	sum, e := hashFile(path, "")
+	if e != nil {
+		return verifyModified, fmt.Sprintf("can not be read: %v", e)
+	}
+	if sum != r.StoredChecksum {
+		return verifyModified, fmt.Sprintf("encrypted file sha256 %s, was %s", sum, r.StoredChecksum)
+	}
+	return verifyOK, "encrypted, checked without the key"
+}
+
+func verify_backup(cmd *cobra.Command, args []string) {
+	file, _ := cmd.Flags().GetString("file")
+	all, _ := cmd.Flags().GetBool("all")
+
+	var index *backupStore
+	var loc backupLocation
+	if all {
+		index = getStore(cmd)
+		if index == nil {
+			exitWithError("--all needs a backup store. Please use the --store flag or set backup.store in the config file.\n")
+		}
+	} else {
+		loc = getBackupLocation(cmd)
+		index = loc.index()
+	}
+	m, e := index.loadManifest()
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the manifest. %v\n", e))
+	}
+
+	type result struct {
+		path   string
+		status string
+		detail string
+	}
+	var results []result
+	recorded := map[string]bool{}
+	for _, r := range m.Backups {
+		switch {
+		case all:
+		case file != "" && r.Source != loc.Source():
+			continue
+		case file == "" && filepath.Dir(r.Source)+"/" != loc.Dir:
+			continue
+		}
+		path := filepath.Join(index.Root, r.Path)
+		recorded[path] = true
+		status, detail := verifyRecord(index, r)
+		results = append(results, result{path, status, detail})
+	}
+
+	// Backups next to the files that the hidden manifest does not know
+	if loc.Store == nil && all == false {
+		groups, e := listBackupGroups(loc.Dir, nil)
+		if e != nil {
+			exitWithError(fmt.Sprintf("Can not read the directory '%s'. %v\n", loc.Dir, e))
+		}
+		for source, backups := range groups {
+			if file != "" && source != loc.Source() {
+				continue
+			}
+			for _, b := range backups {
+				if recorded[b.Path()] == false {
+					results = append(results, result{b.Path(), verifyUnrecorded, "taken before checksums were recorded"})
+				}
+			}
+		}
+	}
+	if len(results) == 0 {
+		fmt.Printf("No backup found\n")
+		return
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].path < results[j].path
+	})
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.status] += 1
+		fmt.Printf("%s%-10s%s %s", colors[verifyColors[r.status]], r.status, colors["reset"], r.path)
+		if r.detail != "" {
+			fmt.Printf(" (%s)", r.detail)
+		}
+		fmt.Printf("\n")
+	}
+	fmt.Printf("\n%d ok, %d modified, %d missing, %d unrecorded\n", counts[verifyOK], counts[verifyModified], counts[verifyMissing], counts[verifyUnrecorded])
+	if counts[verifyModified] > 0 || counts[verifyMissing] > 0 {
+		os.Exit(1)
+	}
+}
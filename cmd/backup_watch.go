@@ -0,0 +1,307 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	backUpCmd.AddCommand(watchBackupCmd)
+	watchBackupCmd.Flags().StringP("dir", "d", "", "Enter the directory of the files, absolute directory not relative.")
+	watchBackupCmd.Flags().StringSliceP("file", "f", nil, "Enter the filename. Repeat the flag or separate names with commas to watch several files. Default is backup.watch.paths in the config file.")
+	watchBackupCmd.Flags().StringP("compress", "c", "", "Compress the backups. Available options are none, gzip and zstd. Default is taken from the config file.")
+	watchBackupCmd.Flags().String("debounce", "", "Wait until a file has not been written for this long before taking a backup. Default is 2s.")
+	addRetentionFlags(watchBackupCmd)
+	watchBackupCmd.Flags().Bool("install-unit", false, "Do not watch, install a systemd service that runs this watch instead.")
+	watchBackupCmd.Flags().String("unit-name", "linate-watch", "Name of the systemd service of --install-unit.")
+	addStoreFlag(watchBackupCmd)
+}
+
+var watchBackupCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Take a backup of files automatically when they change.",
+	Long: `Watch files with inotify and take a backup of the previous content whenever one is written or replaced,
+e.g. by an editor that saves through a temporary file. Several writes in a row are taken as one change. bk watch
+runs in the foreground, --install-unit installs a systemd service that runs it in the background instead. The
+retention policy of the --keep-* flags, or of the config file, is applied after every backup.`,
+	Run: watch_backup,
+}
+
+const defaultDebounce = 2 * time.Second
+
+// inotifyInit starts inotify for bk watch, tests make reading it fail.
+var inotifyInit = unix.InotifyInit1
+
+// watchedFile is a file of bk watch and the copy of its content before the last
+// change.
+type watchedFile struct {
+	loc    backupLocation
+	shadow string
+	sum    string
+}
+
+func watch_backup(cmd *cobra.Command, args []string) {
+	files, _ := cmd.Flags().GetStringSlice("file")
+	dir, _ := cmd.Flags().GetString("dir")
+	install, _ := cmd.Flags().GetBool("install-unit")
+	compression, _ := cmd.Flags().GetString("compress")
+	if compression == "" {
+		compression = getConfig().Backup.Compress
+	}
+	if validCompression(compression) == false {
+		exitWithError(fmt.Sprintf("Unknown compression '%s'. Available options are none, gzip and zstd.\n", compression))
+	}
+	rawDebounce, _ := cmd.Flags().GetString("debounce")
+	if rawDebounce == "" {
+		rawDebounce = getConfig().Backup.Watch.Debounce
+	}
+	debounce := defaultDebounce
+	if rawDebounce != "" {
+		var e error
+		debounce, e = time.ParseDuration(rawDebounce)
+		if e != nil || debounce < 0 {
+			exitWithError(fmt.Sprintf("Invalid debounce '%s'. Please use a duration like 500ms or 2s.\n", rawDebounce))
+		}
+	}
+	policy := getRetentionPolicy(cmd)
+
+	// Files are relative to --dir unless they are absolute
+	if len(files) == 0 {
+		files = getConfig().Backup.Watch.Paths
+	}
+	if len(files) == 0 {
+		exitWithError("No file to watch. Please use the --file flag or set backup.watch.paths in the config file.\n")
+	}
+	if dir == "" {
+		dir = currDir
+	}
+	store := getStore(cmd)
+	var paths []string
+	for _, f := range files {
+		path := f
+		if filepath.IsAbs(path) == false {
+			path = filepath.Join(dir, f)
+		}
+		path, _ = filepath.Abs(path)
+		info, e := os.Stat(path)
+		if e != nil {
+			exitWithError(fmt.Sprintf("File '%s' does not exist or follows a strict permission. Please run as the superuser if the file really exists.\n", path))
+		}
+		if info.IsDir() {
+			exitWithError(fmt.Sprintf("'%s' is a directory. bk watch only watches files.\n", path))
+		}
+		paths = append(paths, path)
+	}
+
+	if install {
+		installWatchUnit(cmd, paths)
+		return
+	}
+
+	if e := watchFiles(paths, store, compression, debounce, policy); e != nil {
+		exitWithError(fmt.Sprintf("%v\n", e))
+	}
+}
+
+// watchFiles takes a backup of the files at paths whenever they change, until
+// inotify fails. It returns instead of exiting so the shadow copies are removed.
+func watchFiles(paths []string, store *backupStore, compression string, debounce time.Duration, policy retentionPolicy) error {
+	// Keep the current content of every file to back it up when it changes. The
+	// copies stay next to the backups, like them out of reach of other users
+	shadowDirs := map[string]string{}
+	var stops []func()
+	defer func() {
+		for _, dir := range shadowDirs {
+			os.RemoveAll(dir)
+		}
+		for _, stop := range stops {
+			stop()
+		}
+	}()
+	watched := map[string]*watchedFile{}
+	for i, path := range paths {
+		loc := locationOf(path, store)
+		shadowDir, ok := shadowDirs[loc.BackupDir()]
+		if ok == false {
+			if e := os.MkdirAll(loc.BackupDir(), 0700); e != nil {
+				return fmt.Errorf("Can not create the directory '%s'. %v", loc.BackupDir(), e)
+			}
+			var e error
+			shadowDir, e = os.MkdirTemp(loc.BackupDir(), ".linate-watch-")
+			if e != nil {
+				return fmt.Errorf("Can not create a temporary directory in '%s'. %v", loc.BackupDir(), e)
+			}
+			shadowDirs[loc.BackupDir()] = shadowDir
+			stops = append(stops, removeOnInterrupt(shadowDir))
+		}
+		w := &watchedFile{loc: loc, shadow: filepath.Join(shadowDir, fmt.Sprintf("%d-%s", i, filepath.Base(path)))}
+		if e := w.keep(); e != nil {
+			return fmt.Errorf("Can not read the file '%s'. %v", path, e)
+		}
+		watched[path] = w
+	}
+
+	fd, e := inotifyInit(unix.IN_CLOEXEC)
+	if e != nil {
+		return fmt.Errorf("Can not start inotify. %v", e)
+	}
+	defer unix.Close(fd)
+	// Watch the directories, editors often replace a file instead of writing it
+	dirs := map[int]string{}
+	for _, path := range paths {
+		wd, e := unix.InotifyAddWatch(fd, filepath.Dir(path), unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO)
+		if e != nil {
+			return fmt.Errorf("Can not watch the directory '%s'. %v", filepath.Dir(path), e)
+		}
+		dirs[wd] = filepath.Dir(path)
+	}
+
+	changed := make(chan string)
+	failed := make(chan error, 1)
+	go readInotifyEvents(fd, dirs, changed, failed)
+	fired := make(chan string)
+	timers := map[string]*time.Timer{}
+	fmt.Printf("%sWatching %d file(s). Press Ctrl+C to stop.%s\n", colors["green"], len(paths), colors["reset"])
+	for {
+		select {
+		case path := <-changed:
+			if watched[path] == nil {
+				continue
+			}
+			if t, ok := timers[path]; ok {
+				t.Reset(debounce)
+				continue
+			}
+			timers[path] = time.AfterFunc(debounce, func() { fired <- path })
+		case path := <-fired:
+			delete(timers, path)
+			watched[path].backUp(compression, policy)
+		case e := <-failed:
+			for _, t := range timers {
+				t.Stop()
+			}
+			return fmt.Errorf("Can not read inotify events. %v", e)
+		}
+	}
+}
+
+// readInotifyEvents sends the path of every file that inotify reports on, and the
+// error to failed when reading fails.
+func readInotifyEvents(fd int, dirs map[int]string, changed chan<- string, failed chan<- error) {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, e := unix.Read(fd, buf)
+		if e == unix.EINTR {
+			continue
+		}
+		if e != nil {
+			failed <- e
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+			offset = nameStart + int(event.Len)
+			if dir, ok := dirs[int(event.Wd)]; ok && name != "" {
+				changed <- filepath.Join(dir, name)
+			}
+		}
+	}
+}
+
+// keep copies the current content of the file to the shadow copy.
+func (w *watchedFile) keep() error {
+	sum, _, e := atomicCopyFile(w.loc.Source(), w.shadow, "", "")
+	if e == nil {
+		w.sum = sum
+	}
+	return e
+}
+
+// backUp takes a backup of the content before the change, if the file really
+// changed, and applies the retention policy.
+func (w *watchedFile) backUp(compression string, policy retentionPolicy) {
+	source := w.loc.Source()
+	sum, e := hashFile(source, "")
+	if e != nil {
+		// Removed or being replaced, the next event brings it back
+		return
+	}
+	if sum == w.sum {
+		return
+	}
+	opts := defaultOptions(w.loc.Store)
+	opts.Compression = compression
+	opts.From = w.shadow
+	path, lost, e := createBackup(w.loc, opts)
+	if e != nil {
+		fmt.Printf("%s%s Can not take a backup of '%s'. %v%s\n", colors["red"], time.Now().Format(time.DateTime), source, e, colors["reset"])
+		return
+	}
+	fmt.Printf("%s%s '%s' changed, the previous content has been saved as '%s'%s\n", colors["green"], time.Now().Format(time.DateTime), source, path, colors["reset"])
+	printLostMetadata(lost)
+	if e = w.keep(); e != nil {
+		fmt.Printf("%sCan not read the file '%s'. %v%s\n", colors["red"], source, e, colors["reset"])
+	}
+
+	if policy.isEmpty() {
+		return
+	}
+	backups, e := w.loc.list()
+	if e != nil {
+		fmt.Printf("%sCan not read the backups of '%s'. %v%s\n", colors["red"], source, e, colors["reset"])
+		return
+	}
+	if deleteBackups(policy.forget(map[string][]backupFile{source: backups}), w.loc.Store) == 0 {
+		collectChunks(w.loc.Store)
+	}
+}
+
+// installWatchUnit installs a systemd service that runs bk watch with the flags of
+// this command.
+func installWatchUnit(cmd *cobra.Command, paths []string) {
+	unitName, _ := cmd.Flags().GetString("unit-name")
+	args := []string{"bk", "watch"}
+	for _, path := range paths {
+		args = append(args, "--file", path)
+	}
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		switch f.Name {
+		case "file", "dir", "install-unit", "unit-name":
+			return
+		case "store":
+			root, _ := filepath.Abs(f.Value.String())
+			args = append(args, "--store", root)
+			return
+		}
+		args = append(args, "--"+f.Name, f.Value.String())
+	})
+
+	unit := fmt.Sprintf(`[Unit]
+Description=linate backups of changed files
+After=local-fs.target
+
+[Service]
+Type=simple
+ExecStart=%s
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`, linateCommandLine(args, systemdQuote))
+	path, e := installSystemdUnit(unitName+".service", unit)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not write the unit file '%s'. Please run as the superuser. %v\n", path, e))
+	}
+	fmt.Printf("%sThe systemd service has been written to '%s'%s\n", colors["green"], path, colors["reset"])
+	fmt.Printf("Run 'systemctl daemon-reload && systemctl enable --now %s' to start it.\n", unitName)
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReadInotifyEventsFails(t *testing.T) {
+	fd, e := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if e != nil {
+		t.Skip(e)
+	}
+	unix.Close(fd)
+	failed := make(chan error, 1)
+	go readInotifyEvents(fd, nil, make(chan string), failed)
+	select {
+	case e := <-failed:
+		if e == nil {
+			t.Error("the error is nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reading a closed inotify descriptor does not fail")
+	}
+}
+
+func TestWatchFilesFails(t *testing.T) {
+	loadedConfig = &linateConfig{}
+	dir := t.TempDir()
+	source := filepath.Join(dir, "nginx.conf")
+	if e := os.WriteFile(source, []byte("listen 80\n"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	store := &backupStore{Root: t.TempDir()}
+	// Reading a non-blocking descriptor without events fails right away
+	init := inotifyInit
+	inotifyInit = func(flags int) (int, error) {
+		return unix.InotifyInit1(flags | unix.IN_NONBLOCK)
+	}
+	defer func() { inotifyInit = init }()
+
+	for _, s := range []*backupStore{nil, store} {
+		if e := watchFiles([]string{source}, s, "", time.Millisecond, retentionPolicy{}); e == nil {
+			t.Fatal("watchFiles returned without an error")
+		}
+		backupDir := locationOf(source, s).BackupDir()
+		entries, e := os.ReadDir(backupDir)
+		if e != nil {
+			t.Fatal(e)
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".linate-watch-") {
+				t.Errorf("the shadow directory %s is left behind in %s", entry.Name(), backupDir)
+			}
+		}
+	}
+}
+
+func TestWatchShadowDir(t *testing.T) {
+	loadedConfig = &linateConfig{}
+	dir := t.TempDir()
+	source := filepath.Join(dir, "nginx.conf")
+	if e := os.WriteFile(source, []byte("listen 80\n"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	// The shadow directory is checked while the watch starts
+	var shadow os.FileInfo
+	init := inotifyInit
+	inotifyInit = func(flags int) (int, error) {
+		matches, _ := filepath.Glob(filepath.Join(dir, ".linate-watch-*"))
+		if len(matches) == 1 {
+			shadow, _ = os.Stat(matches[0])
+		}
+		return -1, unix.EMFILE
+	}
+	defer func() { inotifyInit = init }()
+
+	if e := watchFiles([]string{source}, nil, "", time.Millisecond, retentionPolicy{}); e == nil {
+		t.Fatal("watchFiles returned without an error")
+	}
+	if shadow == nil {
+		t.Fatalf("no shadow directory in %s", dir)
+	}
+	if shadow.Mode().Perm() != 0700 {
+		t.Errorf("the mode of the shadow directory is %v, want 0700", shadow.Mode().Perm())
+	}
+}
@@ -2,17 +2,26 @@ package cmd
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"errors"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"golang.org/x/sys/unix"
 )
 
 
@@ -28,20 +37,276 @@ func toInt(raw string) int {
 }
 
 
-func copyFile(src string, dst string) error {
-	source, e := os.Open(src)
+// copyFile copies src to dst, flushes dst to the disk and returns the sha256 of the
+// copied content. src is decompressed with decode and dst is compressed with encode,
+// see compressionExt.
+func copyFile(src string, dst string, decode string, encode string) (string, error) {
+	size := int64(-1)
+	if info, e := os.Stat(src); e == nil && decode == "" {
+		size = info.Size()
+	}
+	source, e := openDecoded(src, decode)
 	if e != nil {
-		return e
+		return "", e
 	}
 	defer source.Close()
+	return copyReader(source, dst, encode, size)
+}
 
-	dest, e_ := os.Create(dst)
-	if e_ != nil {
-		return e_
+
+// copyReader writes what is read from source to dst like copyFile. size is the size
+// of the content, -1 when it is not known.
+func copyReader(source io.Reader, dst string, encode string, size int64) (string, error) {
+	if encode == "dedup" {
+		return writeChunks(source, dst)
+	}
+	dest, e := os.Create(dst)
+	if e != nil {
+		return "", e
+	}
+	w, e := compressWriter(dest, encode, size)
+	if e != nil {
+		dest.Close()
+		return "", e
+	}
+	h := sha256.New()
+	_, e = io.Copy(io.MultiWriter(w, h), source)
+	if e == nil {
+		e = w.Close()
+	}
+	if e == nil {
+		e = dest.Sync()
+	}
+	if e != nil {
+		dest.Close()
+		return "", e
 	}
-	defer dest.Close()
-	_, er := io.Copy(dest, source)
-	return er
+	if e = dest.Close(); e != nil {
+		return "", e
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+
+// hashFile returns the sha256 of the content of path, decompressed with decode.
+func hashFile(path string, decode string) (string, error) {
+	r, e := openDecoded(path, decode)
+	if e != nil {
+		return "", e
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, e = io.Copy(h, r); e != nil {
+		return "", e
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+
+// atomicCopyFile copies src with its metadata to dst like copyFile. The copy is
+// written to a temporary file in the directory of dst, flushed to the disk and
+// verified against src before it is renamed to dst, so dst is either complete or
+// untouched. It returns the sha256 of the content and the metadata that could not
+// be kept.
+func atomicCopyFile(src string, dst string, decode string, encode string) (string, []string, error) {
+	return atomicWrite(dst, encode, src, func(tmp string) (string, error) {
+		return copyFile(src, tmp, decode, encode)
+	})
+}
+
+
+// atomicWrite creates dst like atomicCopyFile, write fills the temporary file and
+// returns the sha256 of what it wrote before compression. The metadata of metaFrom
+// is copied when it is not empty.
+func atomicWrite(dst string, encode string, metaFrom string, write func(tmp string) (string, error)) (string, []string, error) {
+	tmpName, sum, lost, e := stageWrite(dst, encode, metaFrom, write)
+	if e != nil {
+		return "", nil, e
+	}
+	// Does nothing once the rename succeeded
+	defer os.Remove(tmpName)
+	stop := removeOnInterrupt(tmpName)
+	defer stop()
+	if e = os.Rename(tmpName, dst); e != nil {
+		return "", nil, e
+	}
+	return sum, lost, syncDir(filepath.Dir(dst))
+}
+
+
+// stageWrite is atomicWrite without the rename: it returns the verified temporary
+// file next to dst, the caller renames it to dst or removes it.
+func stageWrite(dst string, encode string, metaFrom string, write func(tmp string) (string, error)) (string, string, []string, error) {
+	dir := filepath.Dir(dst)
+	tmp, e := os.CreateTemp(dir, "."+filepath.Base(dst)+".linate-tmp-")
+	if e != nil {
+		return "", "", nil, e
+	}
+	tmp.Close()
+	tmpName := tmp.Name()
+	stop := removeOnInterrupt(tmpName)
+	defer stop()
+
+	sum, e := write(tmpName)
+	if e != nil {
+		os.Remove(tmpName)
+		return "", "", nil, e
+	}
+	// Without a key an encrypted copy can not be read back, age authenticates it and
+	// the manifest keeps the checksum of the encrypted file. The keys may only be for
+	// other backups, e.g. a passphrase kept for old ones
+	if _, encrypted := splitEncoding(encode); encrypted == false || canDecrypt() {
+		written, e := hashFile(tmpName, encode)
+		if encrypted && errors.Is(e, errWrongKey) {
+			written, e = sum, nil
+		}
+		if e == nil && written != sum {
+			e = fmt.Errorf("verification of '%s' failed, the copy does not match the source", dst)
+		}
+		if e != nil {
+			os.Remove(tmpName)
+			return "", "", nil, e
+		}
+	}
+	var lost []string
+	if metaFrom != "" {
+		lost = copyMetadata(metaFrom, tmpName)
+	}
+	return tmpName, sum, lost, nil
+}
+
+
+// writeFileAtomic writes data to path through a temporary file in the same
+// directory, so path is either complete or untouched.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, e := os.CreateTemp(dir, "."+filepath.Base(path)+".linate-tmp-")
+	if e != nil {
+		return e
+	}
+	// Does nothing once the rename succeeded
+	defer os.Remove(tmp.Name())
+	_, e = tmp.Write(data)
+	if e == nil {
+		e = tmp.Chmod(perm)
+	}
+	if e == nil {
+		e = tmp.Sync()
+	}
+	if e != nil {
+		tmp.Close()
+		return e
+	}
+	if e = tmp.Close(); e != nil {
+		return e
+	}
+	if e = os.Rename(tmp.Name(), path); e != nil {
+		return e
+	}
+	return syncDir(dir)
+}
+
+
+// interruptPaths are removed when linate is interrupted, see removeOnInterrupt. One
+// handler removes all of them, a handler per path could exit before the others ran.
+var (
+	interruptMu    sync.Mutex
+	interruptPaths = map[string]int{}
+	interruptSig   chan os.Signal
+)
+
+
+// removeOnInterrupt removes path and exits when linate is interrupted before the
+// returned function is called.
+func removeOnInterrupt(path string) func() {
+	interruptMu.Lock()
+	defer interruptMu.Unlock()
+	if interruptSig == nil {
+		interruptSig = make(chan os.Signal, 1)
+		go func() {
+			<-interruptSig
+			interruptMu.Lock()
+			for p := range interruptPaths {
+				os.RemoveAll(p)
+			}
+			os.Exit(130)
+		}()
+	}
+	if len(interruptPaths) == 0 {
+		signal.Notify(interruptSig, os.Interrupt, syscall.SIGTERM)
+	}
+	interruptPaths[path] += 1
+	stopped := false
+	return func() {
+		interruptMu.Lock()
+		defer interruptMu.Unlock()
+		if stopped {
+			return
+		}
+		stopped = true
+		interruptPaths[path] -= 1
+		if interruptPaths[path] == 0 {
+			delete(interruptPaths, path)
+		}
+		if len(interruptPaths) == 0 {
+			signal.Stop(interruptSig)
+		}
+	}
+}
+
+
+// syncDir flushes a directory to the disk so a rename inside it survives a crash.
+func syncDir(dir string) error {
+	d, e := os.Open(dir)
+	if e != nil {
+		return e
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+
+// printUnifiedDiff prints a colored unified diff from a to b.
+func printUnifiedDiff(aName string, bName string, a string, b string) {
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(a),
+		B:        splitLines(b),
+		FromFile: aName,
+		ToFile:   bName,
+		Context:  3,
+	})
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		text := strings.TrimSuffix(line, "\n")
+		switch {
+		case text == "":
+			continue
+		case strings.HasPrefix(text, "+++"), strings.HasPrefix(text, "---"):
+			fmt.Printf("%s%s%s\n", colors["yellow"], text, colors["reset"])
+		case strings.HasPrefix(text, "@@"):
+			fmt.Printf("%s%s%s\n", colors["cyan"], text, colors["reset"])
+		case strings.HasPrefix(text, "+"):
+			fmt.Printf("%s%s%s\n", colors["green"], text, colors["reset"])
+		case strings.HasPrefix(text, "-"):
+			fmt.Printf("%s%s%s\n", colors["red"], text, colors["reset"])
+		default:
+			fmt.Println(text)
+		}
+	}
+}
+
+
+// splitLines splits s into lines that keep their newline. A missing newline at the
+// end of s is added so the last line compares equal to a terminated one.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	lines[len(lines)-1] += "\n"
+	return lines
 }
 
 
@@ -109,8 +374,56 @@ func yesNoPrompt(label string, def bool) bool {
 
 
 func exitWithError(errorText string) {
-	fmt.Printf(errorText)
-	os.Exit(1)
+	exitWithErrorCode(errorText, 1)
+}
+
+
+func exitWithErrorCode(errorText string, code int) {
+	fmt.Print(errorText)
+	runExitCleanups()
+	os.Exit(code)
+}
+
+
+// exitCleanups run when linate exits with an error, see onErrorExit. Deferred
+// functions do not run on os.Exit.
+var (
+	exitMu       sync.Mutex
+	exitCleanups = map[int]func(){}
+	exitNext     int
+)
+
+
+// onErrorExit runs cleanup when linate exits with exitWithError before the returned
+// function is called.
+func onErrorExit(cleanup func()) func() {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	id := exitNext
+	exitNext += 1
+	exitCleanups[id] = cleanup
+	return func() {
+		exitMu.Lock()
+		defer exitMu.Unlock()
+		delete(exitCleanups, id)
+	}
+}
+
+
+// runExitCleanups runs the cleanups of onErrorExit, the newest first.
+func runExitCleanups() {
+	exitMu.Lock()
+	var ids []int
+	for id := range exitCleanups {
+		ids = append(ids, id)
+	}
+	cleanups := exitCleanups
+	exitCleanups = map[int]func(){}
+	exitMu.Unlock()
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	for _, id := range ids {
+		cleanups[id]()
+	}
 }
 
 
@@ -191,7 +504,7 @@ func getLastLogin(username string) (time.Time, error) {
 	cmd := exec.Command("last", username, "-t", "YYYY-MM-DD hh:mm:ss")
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return time.Time{}, fmt.Errorf(e)
+		return time.Time{}, errors.New(e)
 	}
 	lines := strings.Split(string(output), "\n")
 	if len(lines) < 2 {
@@ -199,14 +512,14 @@ func getLastLogin(username string) (time.Time, error) {
 	}
 	fields := strings.Fields(lines[0])
 	if len(fields) < 5 {
-		return time.Time{}, fmt.Errorf(e)
+		return time.Time{}, errors.New(e)
 	}
 	timeStr := strings.Join(fields[3:6], " ")
     // Define the layout to match the output of the last command
 	layout := "Mon Jan 2 15:04:05 2006 MST"
 	lastLoginTime, err := time.Parse(layout, timeStr)
 	if err != nil {
-		return time.Time{}, fmt.Errorf(e)
+		return time.Time{}, errors.New(e)
 	}
     // Check if the last login time is the default "never logged in" time
     if lastLoginTime.Year() == 1970 && lastLoginTime.Month() == time.January && lastLoginTime.Day() == 1 {
@@ -263,4 +576,68 @@ func getUsernameFromUID(uid int) (string, error) {
 		return "", err
 	}
 	return u.Username, nil
-}
\ No newline at end of file
+}
+
+
+// parseSize parses a size like 512, 10K, 200M or 1G. The units are powers of 1024.
+func parseSize(raw string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := int64(1)
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	if len(s) > 0 {
+		if m, ok := units[s[len(s)-1:]]; ok {
+			multiplier = m
+			s = s[:len(s)-1]
+		}
+	}
+	n, e := strconv.ParseFloat(s, 64)
+	if e != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", raw)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+
+// parseAge parses an age like 90m, 12h, 30d or 2w.
+func parseAge(raw string) (time.Duration, error) {
+	s := strings.TrimSpace(raw)
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	if len(s) > 0 {
+		if unit, ok := units[s[len(s)-1:]]; ok {
+			n, e := strconv.ParseFloat(s[:len(s)-1], 64)
+			if e != nil || n < 0 {
+				return 0, fmt.Errorf("invalid age '%s'", raw)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	d, e := time.ParseDuration(s)
+	if e != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age '%s'", raw)
+	}
+	return d, nil
+}
+
+
+// isTerminal reports whether f is a terminal, where a prompt can be answered.
+func isTerminal(f *os.File) bool {
+	_, e := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return e == nil
+}
+
+
+// formatSize formats a size in bytes like 1.5 GiB.
+func formatSize(size int64) string {
+	units := []string{"byte", "KiB", "MiB", "GiB", "TiB"}
+	f := float64(size)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i += 1
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d byte", size)
+	}
+	return fmt.Sprintf("%.1f %s", f, units[i])
+}
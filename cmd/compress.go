@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressionExt maps a compression to the extension added to the backup name.
+// dedup is the reference file of a deduplicated backup, see chunkRef.
+var compressionExt = map[string]string{
+	"gzip":  ".gz",
+	"zstd":  ".zst",
+	"dedup": ".ref",
+}
+
+// validCompression reports whether c is a compression bk take understands.
+func validCompression(c string) bool {
+	_, ok := compressionExt[c]
+	return (ok && c != "dedup") || c == "" || c == "none"
+}
+
+// compressionOf returns the compression of a backup file from its name.
+func compressionOf(name string) string {
+	for c, ext := range compressionExt {
+		if strings.HasSuffix(name, ext) {
+			return c
+		}
+	}
+	return ""
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressWriter compresses what is written to w. size is the size of the content,
+// zstd keeps it in the frame header so bk check can show it without decompressing.
+func compressWriter(w io.Writer, compression string, size int64) (io.WriteCloser, error) {
+	if c, encrypted := splitEncoding(compression); encrypted {
+		enc, e := encryptWriter(w)
+		if e != nil {
+			return nil, e
+		}
+		cw, e := compressWriter(enc, c, size)
+		if e != nil {
+			return nil, e
+		}
+		return stackedWriteCloser{cw, enc}, nil
+	}
+	switch compression {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		enc, e := zstd.NewWriter(nil)
+		if e != nil {
+			return nil, e
+		}
+		enc.ResetContentSize(w, size)
+		return enc, nil
+	case "", "none":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unknown compression '%s'", compression)
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// decompressReader decompresses what is read from r.
+func decompressReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	if c, encrypted := splitEncoding(compression); encrypted {
+		d, e := decryptReader(r)
+		if e != nil {
+			return nil, e
+		}
+		return decompressReader(d, c)
+	}
+	switch compression {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		dec, e := zstd.NewReader(r)
+		if e != nil {
+			return nil, e
+		}
+		return zstdReadCloser{dec}, nil
+	case "", "none":
+		return io.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("unknown compression '%s'", compression)
+}
+
+type backupReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (b backupReader) Close() error {
+	b.ReadCloser.Close()
+	return b.file.Close()
+}
+
+// openBackup opens a backup file and decrypts and decompresses it according to its
+// name.
+func openBackup(path string) (io.ReadCloser, error) {
+	return openDecoded(path, encodingOf(path))
+}
+
+// openDecoded opens path and decompresses it with decode.
+func openDecoded(path string, decode string) (io.ReadCloser, error) {
+	if decode == "dedup" {
+		return openChunks(path)
+	}
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	r, e := decompressReader(f, decode)
+	if e != nil {
+		f.Close()
+		return nil, e
+	}
+	return backupReader{r, f}, nil
+}
+
+// readBackup returns the original content of a backup file.
+func readBackup(path string) ([]byte, error) {
+	r, e := openBackup(path)
+	if e != nil {
+		return nil, e
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// maxDeflateRatio is the highest compression ratio of deflate, the original of a
+// gzip file is at most this many times larger.
+const maxDeflateRatio = 1032
+
+// errSizeUnknown is returned by originalSize when the size is not stored in the
+// backup file.
+var errSizeUnknown = errors.New("the size before compression is unknown")
+
+// originalSize returns the size of the content of a backup file before compression.
+// Encrypted backups are decrypted to count it. The size of a gzip file of more than
+// 4 MiB is unknown, gzip only stores it modulo 2^32.
+func originalSize(path string, info os.FileInfo) (int64, error) {
+	switch encodingOf(path) {
+	case "dedup":
+		ref, e := readChunkRef(path)
+		return ref.Size, e
+	case "gzip":
+		// The last 4 bytes hold the size modulo 2^32, deflate compresses at most
+		// maxDeflateRatio to 1 so only small backups can not have wrapped
+		if info.Size() > (1<<32)/maxDeflateRatio {
+			return 0, errSizeUnknown
+		}
+		f, e := os.Open(path)
+		if e != nil {
+			return 0, e
+		}
+		defer f.Close()
+		var b [4]byte
+		if _, e = f.ReadAt(b[:], info.Size()-4); e != nil {
+			return 0, e
+		}
+		return int64(binary.LittleEndian.Uint32(b[:])), nil
+	case "zstd":
+		f, e := os.Open(path)
+		if e != nil {
+			return 0, e
+		}
+		defer f.Close()
+		b := make([]byte, zstd.HeaderMaxSize)
+		n, e := f.Read(b)
+		if e != nil {
+			return 0, e
+		}
+		var h zstd.Header
+		if e = h.Decode(b[:n]); e != nil {
+			return 0, e
+		}
+		if h.HasFCS {
+			return int64(h.FrameContentSize), nil
+		}
+		// Small backups are written in a single frame without the size
+		r, e := openBackup(path)
+		if e != nil {
+			return 0, e
+		}
+		defer r.Close()
+		return io.Copy(io.Discard, r)
+	}
+	if _, encrypted := splitEncoding(encodingOf(path)); encrypted {
+		r, e := openBackup(path)
+		if e != nil {
+			return 0, e
+		}
+		defer r.Close()
+		return io.Copy(io.Discard, r)
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeGzip writes content gzipped to a backup file in dir and returns its path.
+func writeGzip(t *testing.T, dir string, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	f, e := os.Create(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	w := gzip.NewWriter(f)
+	if _, e = w.Write(content); e != nil {
+		t.Fatal(e)
+	}
+	if e = w.Close(); e != nil {
+		t.Fatal(e)
+	}
+	if e = f.Close(); e != nil {
+		t.Fatal(e)
+	}
+	return path
+}
+
+func TestOriginalSizeGzip(t *testing.T) {
+	dir := t.TempDir()
+	small := writeGzip(t, dir, "small.conf-20250503T142530-1.gz", []byte("listen 80\n"))
+	info, _ := os.Stat(small)
+	if size, e := originalSize(small, info); e != nil || size != 10 {
+		t.Errorf("originalSize = %d, %v, want 10", size, e)
+	}
+
+	// Random content does not compress, the gzip file is large enough to hold an
+	// original of 4 GiB or more
+	content := make([]byte, 5<<20)
+	rand.Read(content)
+	large := writeGzip(t, dir, "large.img-20250503T142530-1.gz", content)
+	info, _ = os.Stat(large)
+	if size, e := originalSize(large, info); errors.Is(e, errSizeUnknown) == false {
+		t.Errorf("originalSize = %d, %v, want an unknown size", size, e)
+	}
+
+	b, _ := parseBackupName(filepath.Base(large))
+	backup := backupFile{backupName: b, Dir: dir + "/", Name: filepath.Base(large), Info: info}
+	if row := newFileInfo(backup); row.OriginalSize != "unknown" {
+		t.Errorf("the original size is %q, want unknown", row.OriginalSize)
+	}
+	backup.Record = &manifestRecord{Size: int64(len(content))}
+	if row := newFileInfo(backup); row.OriginalSize != "5242880 byte" {
+		t.Errorf("the original size is %q, want the size of the record", row.OriginalSize)
+	}
+}
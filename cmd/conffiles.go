@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// States of a conffile compared with what its package shipped.
+const (
+	conffileModified   = "modified"
+	conffileMissing    = "missing"
+	conffileUnreadable = "unreadable"
+)
+
+// dpkgStatusPath is the database of dpkg. The Conffiles field of a package lists
+// its conffiles with the md5sum of the shipped version.
+var dpkgStatusPath = "/var/lib/dpkg/status"
+
+// conffile is a configuration file of a package that differs from the shipped one.
+type conffile struct {
+	Path    string
+	Package string
+	State   string
+}
+
+// modifiedConffiles returns the conffiles of the dpkg and rpm packages that have been
+// changed, removed or can not be read, sorted by path.
+func modifiedConffiles() ([]conffile, error) {
+	files, e := dpkgModifiedConffiles()
+	if e != nil {
+		return nil, e
+	}
+	rpmFiles, e := rpmModifiedConffiles()
+	if e != nil {
+		return nil, e
+	}
+	files = append(files, rpmFiles...)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
+
+// dpkgModifiedConffiles compares the conffiles of the dpkg status file with their
+// md5sums. Obsolete conffiles and the ones of packages not configured yet are
+// skipped. There are none without dpkg.
+func dpkgModifiedConffiles() ([]conffile, error) {
+	f, e := os.Open(dpkgStatusPath)
+	if errors.Is(e, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+
+	var files []conffile
+	pkg := ""
+	inConffiles := false
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			pkg = ""
+			inConffiles = false
+			continue
+		}
+		if strings.HasPrefix(line, " ") == false {
+			inConffiles = strings.HasPrefix(line, "Conffiles:")
+			if name, ok := strings.CutPrefix(line, "Package:"); ok {
+				pkg = strings.TrimSpace(name)
+			}
+			continue
+		}
+		if inConffiles == false {
+			continue
+		}
+		// " /etc/adduser.conf cc3493ecd2d09837ffdcc3e25fdfff18 [obsolete]"
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] == "newconffile" || arrContains(fields[2:], "obsolete") {
+			continue
+		}
+		if state := md5State(fields[0], fields[1]); state != "" {
+			files = append(files, conffile{Path: fields[0], Package: pkg, State: state})
+		}
+	}
+	return files, scanner.Err()
+}
+
+// md5State returns the state of the file at path against the md5sum of its package,
+// empty when it is unchanged.
+func md5State(path string, sum string) string {
+	f, e := os.Open(path)
+	if errors.Is(e, fs.ErrNotExist) {
+		return conffileMissing
+	}
+	if e != nil {
+		return conffileUnreadable
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, e = io.Copy(h, f); e != nil {
+		return conffileUnreadable
+	}
+	if hex.EncodeToString(h.Sum(nil)) == sum {
+		return ""
+	}
+	return conffileModified
+}
+
+// rpmModifiedConffiles asks rpm to verify the installed packages and keeps the config
+// files whose size or digest changed. There are none without rpm.
+func rpmModifiedConffiles() ([]conffile, error) {
+	if _, e := exec.LookPath("rpm"); e != nil {
+		return nil, nil
+	}
+	// rpm -V exits with 1 when any file differs, the output tells what
+	out, e := exec.Command("rpm", "-Va", "--nodeps", "--noscripts", "--nomtime").Output()
+	var exit *exec.ExitError
+	if e != nil && errors.As(e, &exit) == false {
+		return nil, e
+	}
+
+	var files []conffile
+	for _, line := range strings.Split(string(out), "\n") {
+		// "S.5....T.  c /etc/ssh/sshd_config" or "missing   c /etc/foo.conf"
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "c" {
+			continue
+		}
+		path := strings.Join(fields[2:], " ")
+		attrs := fields[0]
+		state := conffileModified
+		if attrs == "missing" {
+			state = conffileMissing
+		} else if len(attrs) > 2 && attrs[2] == '?' {
+			// The digest could not be computed
+			state = conffileUnreadable
+		} else if strings.ContainsAny(attrs, "S5") == false {
+			// Only the mode, owner or times changed, the content is the shipped one
+			continue
+		}
+		files = append(files, conffile{Path: path, Package: rpmPackageOf(path), State: state})
+	}
+	return files, nil
+}
+
+// rpmPackageOf returns the name of the package owning the file at path.
+func rpmPackageOf(path string) string {
+	out, e := exec.Command("rpm", "-qf", "--queryformat", "%{NAME}\\n", path).Output()
+	if e != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+}
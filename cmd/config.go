@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigPath is read when LINATE_CONFIG is not set. A missing file is not an error.
+const defaultConfigPath = "/etc/linate/config.yaml"
+
+// linateConfig is the content of the linate config file.
+type linateConfig struct {
+	Backup backupConfig `yaml:"backup"`
+}
+
+type backupConfig struct {
+	// Compress is the default compression of bk take: none, gzip or zstd
+	Compress string `yaml:"compress"`
+	// Store is the default backup store directory, see backupStore
+	Store string `yaml:"store"`
+	// Dedup keeps the backups of the store as deduplicated chunks, see chunkRef
+	Dedup bool `yaml:"dedup"`
+	// Encrypt encrypts every backup with the keys of Encryption
+	Encrypt    bool             `yaml:"encrypt"`
+	Encryption encryptionConfig `yaml:"encryption"`
+	// Retention is the default policy of bk prune
+	Retention retentionConfig `yaml:"retention"`
+	// Watch is the default of bk watch
+	Watch watchConfig `yaml:"watch"`
+	Hooks hooksConfig `yaml:"hooks"`
+	// Profiles are the named sets of files of bk take --profile
+	Profiles map[string]profileConfig `yaml:"profiles"`
+	// History commits the files to the history repository instead, see historyRepo
+	History bool `yaml:"history"`
+	// Quota keeps bk take from filling the disk, see checkSpace
+	Quota quotaConfig `yaml:"quota"`
+}
+
+type quotaConfig struct {
+	// Reserve is the space bk take leaves free on the filesystem, e.g. 10% or 2G
+	Reserve string `yaml:"reserve"`
+	// MaxTotalSize limits every backup of the store, or of a directory when the
+	// backups are kept next to the files
+	MaxTotalSize string `yaml:"max_total_size"`
+	// Directories limit the backups of the files of a directory, e.g. /etc/nginx: 100M
+	Directories map[string]string `yaml:"directories"`
+}
+
+type retentionConfig struct {
+	KeepLast     int    `yaml:"keep_last"`
+	KeepDaily    int    `yaml:"keep_daily"`
+	KeepWeekly   int    `yaml:"keep_weekly"`
+	KeepMonthly  int    `yaml:"keep_monthly"`
+	MaxTotalSize string `yaml:"max_total_size"`
+}
+
+// encryptionConfig holds the keys of encrypted backups, see encryptionRecipients.
+type encryptionConfig struct {
+	// Recipients are age public keys, age1...
+	Recipients []string `yaml:"recipients"`
+	// IdentityFile holds the age private keys that decrypt backups
+	IdentityFile   string `yaml:"identity_file"`
+	PassphraseFile string `yaml:"passphrase_file"`
+}
+
+// hooksConfig holds the shell commands of every hook, see runHooks.
+type hooksConfig struct {
+	PreTake     []string `yaml:"pre_take"`
+	PostTake    []string `yaml:"post_take"`
+	PreDelete   []string `yaml:"pre_delete"`
+	PostRestore []string `yaml:"post_restore"`
+}
+
+// profileConfig lists the files of a profile, see expandProfile.
+type profileConfig struct {
+	// Paths are absolute paths and globs, e.g. /etc/nginx/sites-enabled/*
+	Paths []string `yaml:"paths"`
+}
+
+type watchConfig struct {
+	// Paths are the absolute paths of the files to watch
+	Paths    []string `yaml:"paths"`
+	Debounce string   `yaml:"debounce"`
+}
+
+var loadedConfig *linateConfig
+
+// getConfig reads the config file once and exits on an invalid one.
+func getConfig() *linateConfig {
+	if loadedConfig != nil {
+		return loadedConfig
+	}
+	path := os.Getenv("LINATE_CONFIG")
+	if path == "" {
+		path = defaultConfigPath
+	}
+	loadedConfig = &linateConfig{}
+	data, e := os.ReadFile(path)
+	if os.IsNotExist(e) && os.Getenv("LINATE_CONFIG") == "" {
+		return loadedConfig
+	}
+	if e != nil {
+		exitWithError(fmt.Sprintf("Can not read the config file '%s'. %v\n", path, e))
+	}
+	e = yaml.Unmarshal(data, loadedConfig)
+	if e != nil {
+		exitWithError(fmt.Sprintf("Invalid config file '%s'. %v\n", path, e))
+	}
+	return loadedConfig
+}
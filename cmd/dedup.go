@@ -0,0 +1,342 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// A deduplicated backup is a small reference file, named like a backup with a .ref
+// extension, that lists the chunks of the content. Chunks are cut where the content
+// itself says so (content-defined chunking), so an unchanged part of a file gives the
+// same chunks in every backup. They are kept once, compressed with zstd, in
+// <store>/.linate-chunks/<first two hex digits>/<sha256>.
+const chunkDirName = ".linate-chunks"
+
+const (
+	minChunkSize = 16 << 10
+	maxChunkSize = 256 << 10
+	// A cut needs the 16 top bits of the hash to be zero, about every 64 KiB
+	chunkMask = uint64(1<<16-1) << 48
+)
+
+// Chunks younger than this are never collected, a backup being taken may use them
+// before it is referenced.
+const chunkGracePeriod = time.Hour
+
+// chunkRef is the content of a reference file.
+type chunkRef struct {
+	Version int      `json:"version"`
+	Size    int64    `json:"size"`
+	Chunks  []string `json:"chunks"`
+}
+
+// gearTable holds the random numbers of the rolling hash. It is generated with
+// splitmix64 from a fixed seed, chunk boundaries must never change.
+var gearTable = func() [256]uint64 {
+	var t [256]uint64
+	x := uint64(0x6c696e617465)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// nextChunk reads the next chunk of r into buf and returns it, io.EOF when r is
+// exhausted.
+func nextChunk(r *bufio.Reader, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	var hash uint64
+	for len(buf) < maxChunkSize {
+		b, e := r.ReadByte()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return nil, e
+		}
+		buf = append(buf, b)
+		hash = hash<<1 + gearTable[b]
+		if len(buf) >= minChunkSize && hash&chunkMask == 0 {
+			break
+		}
+	}
+	if len(buf) == 0 {
+		return nil, io.EOF
+	}
+	return buf, nil
+}
+
+// chunkRoot returns the store that keeps the chunks of the reference file at path,
+// the closest parent directory with a chunk directory.
+func chunkRoot(path string) (string, error) {
+	dir := filepath.Dir(path)
+	for {
+		if dirExists(filepath.Join(dir, chunkDirName)) {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no %s directory found above '%s'", chunkDirName, path)
+		}
+		dir = parent
+	}
+}
+
+func chunkPath(root string, sum string) string {
+	return filepath.Join(root, chunkDirName, sum[:2], sum)
+}
+
+// writeChunks stores the chunks of what is read from source and writes the reference
+// file dst. It returns the sha256 of the whole content like copyReader.
+func writeChunks(source io.Reader, dst string) (string, error) {
+	root, e := chunkRoot(dst)
+	if e != nil {
+		return "", e
+	}
+	enc, e := zstd.NewWriter(nil)
+	if e != nil {
+		return "", e
+	}
+	defer enc.Close()
+
+	ref := chunkRef{Version: 1}
+	whole := sha256.New()
+	r := bufio.NewReaderSize(io.TeeReader(source, whole), maxChunkSize)
+	buf := make([]byte, 0, maxChunkSize)
+	now := time.Now()
+	for {
+		chunk, e := nextChunk(r, buf)
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return "", e
+		}
+		sum := sha256.Sum256(chunk)
+		name := hex.EncodeToString(sum[:])
+		path := chunkPath(root, name)
+		// A known chunk is touched so the garbage collector leaves it alone
+		if os.Chtimes(path, now, now) != nil {
+			if e = os.MkdirAll(filepath.Dir(path), 0700); e != nil {
+				return "", e
+			}
+			if e = writeFileAtomic(path, enc.EncodeAll(chunk, nil), 0600); e != nil {
+				return "", e
+			}
+		}
+		ref.Chunks = append(ref.Chunks, name)
+		ref.Size += int64(len(chunk))
+	}
+
+	data, e := json.Marshal(ref)
+	if e != nil {
+		return "", e
+	}
+	f, e := os.Create(dst)
+	if e != nil {
+		return "", e
+	}
+	_, e = f.Write(data)
+	if e == nil {
+		e = f.Sync()
+	}
+	if e != nil {
+		f.Close()
+		return "", e
+	}
+	if e = f.Close(); e != nil {
+		return "", e
+	}
+	return hex.EncodeToString(whole.Sum(nil)), nil
+}
+
+func readChunkRef(path string) (chunkRef, error) {
+	var ref chunkRef
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return ref, e
+	}
+	if e = json.Unmarshal(data, &ref); e != nil {
+		return ref, fmt.Errorf("invalid reference file '%s': %v", path, e)
+	}
+	return ref, nil
+}
+
+// chunkReader reads the content of a reference file chunk by chunk.
+type chunkReader struct {
+	root   string
+	chunks []string
+	dec    *zstd.Decoder
+	rest   *bytes.Reader
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for c.rest == nil || c.rest.Len() == 0 {
+		if len(c.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, e := os.ReadFile(chunkPath(c.root, c.chunks[0]))
+		if errors.Is(e, fs.ErrNotExist) {
+			return 0, fmt.Errorf("chunk %s is missing", c.chunks[0])
+		}
+		if e != nil {
+			return 0, e
+		}
+		data, e = c.dec.DecodeAll(data, nil)
+		if e != nil {
+			return 0, fmt.Errorf("chunk %s is damaged: %v", c.chunks[0], e)
+		}
+		c.rest = bytes.NewReader(data)
+		c.chunks = c.chunks[1:]
+	}
+	return c.rest.Read(p)
+}
+
+func (c *chunkReader) Close() error {
+	c.dec.Close()
+	return nil
+}
+
+// openChunks opens the content of the reference file at path.
+func openChunks(path string) (io.ReadCloser, error) {
+	ref, e := readChunkRef(path)
+	if e != nil {
+		return nil, e
+	}
+	root, e := chunkRoot(path)
+	if e != nil {
+		return nil, e
+	}
+	dec, e := zstd.NewReader(nil)
+	if e != nil {
+		return nil, e
+	}
+	return &chunkReader{root: root, chunks: ref.Chunks, dec: dec}, nil
+}
+
+// chunkUsage returns the size of the content of backups and what they take on the
+// disk, counting every chunk once.
+func chunkUsage(backups []backupFile) (int64, int64) {
+	var logical, physical int64
+	seen := map[string]bool{}
+	for _, b := range backups {
+		physical += b.Info.Size()
+		if b.Encrypted && b.Record != nil {
+			logical += b.Record.Size
+			continue
+		}
+		if b.Compression != "dedup" {
+			size, e := originalSize(b.Path(), b.Info)
+			if errors.Is(e, errSizeUnknown) && b.Record != nil {
+				size, e = b.Record.Size, nil
+			}
+			if e == nil {
+				logical += size
+			}
+			continue
+		}
+		ref, e := readChunkRef(b.Path())
+		if e != nil {
+			continue
+		}
+		logical += ref.Size
+		root, e := chunkRoot(b.Path())
+		if e != nil {
+			continue
+		}
+		for _, sum := range ref.Chunks {
+			if seen[sum] {
+				continue
+			}
+			seen[sum] = true
+			if info, e := os.Stat(chunkPath(root, sum)); e == nil {
+				physical += info.Size()
+			}
+		}
+	}
+	return logical, physical
+}
+
+// collectGarbage removes the chunks of the store that no reference file uses. It
+// returns how many chunks were removed and their size.
+func (s *backupStore) collectGarbage() (int, int64, error) {
+	chunkDir := filepath.Join(s.Root, chunkDirName)
+	if dirExists(chunkDir) == false {
+		return 0, 0, nil
+	}
+	used := map[string]bool{}
+	e := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+		if d.IsDir() && path == chunkDir {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || compressionOf(path) != "dedup" {
+			return nil
+		}
+		ref, e := readChunkRef(path)
+		if e != nil {
+			return e
+		}
+		for _, sum := range ref.Chunks {
+			used[sum] = true
+		}
+		return nil
+	})
+	if e != nil {
+		return 0, 0, e
+	}
+
+	removed := 0
+	var size int64
+	e = filepath.WalkDir(chunkDir, func(path string, d fs.DirEntry, e error) error {
+		if e != nil || d.IsDir() || used[d.Name()] || strings.Contains(d.Name(), ".linate-tmp-") {
+			return e
+		}
+		info, e := d.Info()
+		if e != nil || time.Since(info.ModTime()) < chunkGracePeriod {
+			return nil
+		}
+		if e = os.Remove(path); e != nil {
+			return e
+		}
+		removed += 1
+		size += info.Size()
+		return nil
+	})
+	return removed, size, e
+}
+
+// collectChunks runs the garbage collector of a store after backups were deleted and
+// reports what it freed.
+func collectChunks(store *backupStore) {
+	if store == nil {
+		return
+	}
+	removed, size, e := store.collectGarbage()
+	if e != nil {
+		fmt.Printf("%sUnused chunks could not be removed. %v%s\n", colors["yellow"], e, colors["reset"])
+		return
+	}
+	if removed > 0 {
+		fmt.Printf("%s%d unused chunk(s) removed, %s freed%s\n", colors["green"], removed, formatSize(size), colors["reset"])
+	}
+}
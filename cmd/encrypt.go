@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// Encrypted backups are age files, https://age-encryption.org, with an .age
+// extension after the compression extension. The content is compressed first. The
+// encoding of an encrypted backup is its compression followed by encryptedSuffix,
+// e.g. zstd+age.
+const (
+	encryptedExt    = ".age"
+	encryptedSuffix = "+age"
+)
+
+// Keys are read from the environment first, then from the config file.
+const (
+	recipientsEnv = "LINATE_AGE_RECIPIENTS"
+	identityEnv   = "LINATE_AGE_IDENTITY"
+	passphraseEnv = "LINATE_PASSPHRASE"
+)
+
+var errNoEncryptionKey = fmt.Errorf("no key to encrypt with. Please set %s or %s, or backup.encryption in the config file", recipientsEnv, passphraseEnv)
+
+var errWrongKey = errors.New("none of the keys can decrypt it, the key or the passphrase is wrong")
+
+var errNoDecryptionKey = fmt.Errorf("no key to decrypt with. Please set %s or %s, or backup.encryption in the config file", identityEnv, passphraseEnv)
+
+// splitEncoding returns the compression of an encoding and whether it is encrypted.
+func splitEncoding(encoding string) (string, bool) {
+	return strings.CutSuffix(encoding, encryptedSuffix)
+}
+
+// encodingOf returns the encoding of a backup file from its name.
+func encodingOf(name string) string {
+	rest, encrypted := strings.CutSuffix(name, encryptedExt)
+	if encrypted {
+		return compressionOf(rest) + encryptedSuffix
+	}
+	return compressionOf(name)
+}
+
+// readPassphrase returns the passphrase of the environment or of the passphrase
+// file of the config file, empty when there is none.
+func readPassphrase() (string, error) {
+	if p := os.Getenv(passphraseEnv); p != "" {
+		return p, nil
+	}
+	path := getConfig().Backup.Encryption.PassphraseFile
+	if path == "" {
+		return "", nil
+	}
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return "", e
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// encryptionRecipients returns who backups are encrypted to: the age recipients of
+// the environment or the config file, otherwise a passphrase.
+func encryptionRecipients() ([]age.Recipient, error) {
+	raw := getConfig().Backup.Encryption.Recipients
+	if env := os.Getenv(recipientsEnv); env != "" {
+		raw = strings.Split(env, ",")
+	}
+	var recipients []age.Recipient
+	for _, s := range raw {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		r, e := age.ParseX25519Recipient(s)
+		if e != nil {
+			return nil, fmt.Errorf("invalid recipient '%s': %v", s, e)
+		}
+		recipients = append(recipients, r)
+	}
+	if len(recipients) > 0 {
+		return recipients, nil
+	}
+	passphrase, e := readPassphrase()
+	if e != nil {
+		return nil, e
+	}
+	if passphrase == "" {
+		return nil, errNoEncryptionKey
+	}
+	r, e := age.NewScryptRecipient(passphrase)
+	if e != nil {
+		return nil, e
+	}
+	return []age.Recipient{r}, nil
+}
+
+// decryptionIdentities returns the keys that decrypt backups: the identity file of
+// the environment or the config file, and the passphrase.
+func decryptionIdentities() ([]age.Identity, error) {
+	var identities []age.Identity
+	path := os.Getenv(identityEnv)
+	if path == "" {
+		path = getConfig().Backup.Encryption.IdentityFile
+	}
+	if path != "" {
+		f, e := os.Open(path)
+		if e != nil {
+			return nil, e
+		}
+		ids, e := age.ParseIdentities(f)
+		f.Close()
+		if e != nil {
+			return nil, fmt.Errorf("invalid identity file '%s': %v", path, e)
+		}
+		identities = append(identities, ids...)
+	}
+	passphrase, e := readPassphrase()
+	if e != nil {
+		return nil, e
+	}
+	if passphrase != "" {
+		id, e := age.NewScryptIdentity(passphrase)
+		if e != nil {
+			return nil, e
+		}
+		identities = append(identities, id)
+	}
+	if len(identities) == 0 {
+		return nil, errNoDecryptionKey
+	}
+	return identities, nil
+}
+
+// canDecrypt reports whether there is a key to decrypt backups with.
+func canDecrypt() bool {
+	_, e := decryptionIdentities()
+	return e == nil
+}
+
+// encryptWriter encrypts what is written to w, it must be closed to write the end
+// of the file.
+func encryptWriter(w io.Writer) (io.WriteCloser, error) {
+	recipients, e := encryptionRecipients()
+	if e != nil {
+		return nil, e
+	}
+	return age.Encrypt(w, recipients...)
+}
+
+// decryptReader decrypts what is read from r.
+func decryptReader(r io.Reader) (io.Reader, error) {
+	identities, e := decryptionIdentities()
+	if e != nil {
+		return nil, e
+	}
+	d, e := age.Decrypt(r, identities...)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(e, &noMatch) {
+		return nil, errWrongKey
+	}
+	return d, e
+}
+
+// stackedWriteCloser closes a writer and then the writer below it.
+type stackedWriteCloser struct {
+	io.WriteCloser
+	below io.Closer
+}
+
+func (s stackedWriteCloser) Close() error {
+	if e := s.WriteCloser.Close(); e != nil {
+		return e
+	}
+	return s.below.Close()
+}
@@ -0,0 +1,294 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// The history of files is kept in a bare git repository, in the backup store or in
+// the directory of the files, instead of backup files. Every bk take --history is a
+// commit of one file on the default branch, with the note as the message. The files
+// are mirrored like in a store, or by their name in the repository of a directory.
+const historyDirName = ".linate-history"
+
+// historyRepo is the history repository of a store or a directory.
+type historyRepo struct {
+	Dir  string
+	repo *git.Repository
+}
+
+// historyEntry is a revision of a file in the history.
+type historyEntry struct {
+	Hash    plumbing.Hash
+	Author  string
+	Time    time.Time
+	Note    string
+	Tags    []string
+	Added   int
+	Deleted int
+}
+
+// historyOf returns the directory of the history repository of the file of loc and
+// the path of the file in it.
+func (l backupLocation) historyOf() (string, string) {
+	if l.Store != nil {
+		return filepath.Join(l.Store.Root, historyDirName), strings.TrimPrefix(l.Source(), "/")
+	}
+	return filepath.Join(l.Dir, historyDirName), l.File
+}
+
+// openHistory opens the history repository in dir, nil when there is none. It is
+// created when create is true.
+func openHistory(dir string, create bool) (*historyRepo, error) {
+	repo, e := git.PlainOpen(dir)
+	if errors.Is(e, git.ErrRepositoryNotExists) {
+		if create == false {
+			return nil, nil
+		}
+		if e = os.MkdirAll(dir, 0700); e != nil {
+			return nil, e
+		}
+		repo, e = git.PlainInit(dir, true)
+	}
+	if e != nil {
+		return nil, e
+	}
+	return &historyRepo{Dir: dir, repo: repo}, nil
+}
+
+// head returns the newest commit, nil when there is none yet.
+func (h *historyRepo) head() (*plumbing.Reference, *object.Commit, error) {
+	ref, e := h.repo.Head()
+	if errors.Is(e, plumbing.ErrReferenceNotFound) {
+		return nil, nil, nil
+	}
+	if e != nil {
+		return nil, nil, e
+	}
+	c, e := h.repo.CommitObject(ref.Hash())
+	return ref, c, e
+}
+
+// storeObject writes an object to the repository and returns its hash.
+func (h *historyRepo) storeObject(o interface {
+	Encode(plumbing.EncodedObject) error
+}) (plumbing.Hash, error) {
+	obj := h.repo.Storer.NewEncodedObject()
+	if e := o.Encode(obj); e != nil {
+		return plumbing.ZeroHash, e
+	}
+	return h.repo.Storer.SetEncodedObject(obj)
+}
+
+// storeBlob writes content to the repository and returns its hash.
+func (h *historyRepo) storeBlob(content []byte) (plumbing.Hash, error) {
+	obj := h.repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, e := obj.Writer()
+	if e != nil {
+		return plumbing.ZeroHash, e
+	}
+	if _, e = w.Write(content); e != nil {
+		w.Close()
+		return plumbing.ZeroHash, e
+	}
+	if e = w.Close(); e != nil {
+		return plumbing.ZeroHash, e
+	}
+	return h.repo.Storer.SetEncodedObject(obj)
+}
+
+// writeTree returns the hash of tree, nil for an empty one, with the file at the
+// slash separated path parts set to the blob.
+func (h *historyRepo) writeTree(tree *object.Tree, parts []string, blob plumbing.Hash, mode filemode.FileMode) (plumbing.Hash, error) {
+	var entries []object.TreeEntry
+	if tree != nil {
+		entries = append(entries, tree.Entries...)
+	}
+	entry := object.TreeEntry{Name: parts[0], Mode: mode, Hash: blob}
+	found := -1
+	for i := range entries {
+		if entries[i].Name == parts[0] {
+			found = i
+		}
+	}
+	if len(parts) > 1 {
+		var sub *object.Tree
+		if found >= 0 && entries[found].Mode == filemode.Dir {
+			var e error
+			if sub, e = h.repo.TreeObject(entries[found].Hash); e != nil {
+				return plumbing.ZeroHash, e
+			}
+		}
+		hash, e := h.writeTree(sub, parts[1:], blob, mode)
+		if e != nil {
+			return plumbing.ZeroHash, e
+		}
+		entry.Mode = filemode.Dir
+		entry.Hash = hash
+	}
+	if found >= 0 {
+		entries[found] = entry
+	} else {
+		entries = append(entries, entry)
+	}
+	// git sorts a directory as if its name ended with a slash
+	sortName := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return sortName(entries[i]) < sortName(entries[j])
+	})
+	return h.storeObject(&object.Tree{Entries: entries})
+}
+
+// commit records content as the file at path. It returns the new commit, or the
+// zero hash when the file already has this content and mode.
+func (h *historyRepo) commit(path string, content []byte, mode filemode.FileMode, author object.Signature, message string) (plumbing.Hash, error) {
+	ref, parent, e := h.head()
+	if e != nil {
+		return plumbing.ZeroHash, e
+	}
+	blob := plumbing.ComputeHash(plumbing.BlobObject, content)
+	var tree *object.Tree
+	if parent != nil {
+		if tree, e = parent.Tree(); e != nil {
+			return plumbing.ZeroHash, e
+		}
+		if entry, e := tree.FindEntry(path); e == nil && entry.Hash == blob && entry.Mode == mode {
+			return plumbing.ZeroHash, nil
+		}
+	}
+	if _, e = h.storeBlob(content); e != nil {
+		return plumbing.ZeroHash, e
+	}
+	treeHash, e := h.writeTree(tree, strings.Split(path, "/"), blob, mode)
+	if e != nil {
+		return plumbing.ZeroHash, e
+	}
+	c := &object.Commit{Author: author, Committer: author, Message: message, TreeHash: treeHash}
+	if parent != nil {
+		c.ParentHashes = []plumbing.Hash{parent.Hash}
+	}
+	hash, e := h.storeObject(c)
+	if e != nil {
+		return plumbing.ZeroHash, e
+	}
+
+	// Another bk take may have committed meanwhile, the branch only moves from the
+	// commit this one is based on
+	branch := plumbing.NewBranchReferenceName("master")
+	if head, e := h.repo.Storer.Reference(plumbing.HEAD); e == nil && head.Type() == plumbing.SymbolicReference {
+		branch = head.Target()
+	}
+	if e = h.repo.Storer.CheckAndSetReference(plumbing.NewHashReference(branch, hash), ref); e != nil {
+		return plumbing.ZeroHash, fmt.Errorf("the history has changed meanwhile, please try again: %v", e)
+	}
+	return hash, nil
+}
+
+// log returns the revisions of the file at path, newest first.
+func (h *historyRepo) log(path string) ([]historyEntry, error) {
+	ref, _, e := h.head()
+	if e != nil || ref == nil {
+		return nil, e
+	}
+	commits, e := h.repo.Log(&git.LogOptions{From: ref.Hash(), FileName: &path})
+	if e != nil {
+		return nil, e
+	}
+	var entries []historyEntry
+	e = commits.ForEach(func(c *object.Commit) error {
+		note, tags := parseHistoryMessage(c.Message)
+		entry := historyEntry{Hash: c.Hash, Author: c.Author.Name, Time: c.Author.When, Note: note, Tags: tags}
+		stats, e := c.Stats()
+		if e != nil {
+			return e
+		}
+		for _, s := range stats {
+			if s.Name == path {
+				entry.Added += s.Addition
+				entry.Deleted += s.Deletion
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, e
+}
+
+// resolve returns the commit of a revision, a hash, an abbreviated hash or a ref.
+func (h *historyRepo) resolve(rev string) (*object.Commit, error) {
+	hash, e := h.repo.ResolveRevision(plumbing.Revision(rev))
+	if e != nil {
+		return nil, e
+	}
+	return h.repo.CommitObject(*hash)
+}
+
+// read returns the content and the mode of the file at path in a commit.
+func (h *historyRepo) read(c *object.Commit, path string) ([]byte, filemode.FileMode, error) {
+	f, e := c.File(path)
+	if e != nil {
+		return nil, 0, e
+	}
+	r, e := f.Reader()
+	if e != nil {
+		return nil, 0, e
+	}
+	defer r.Close()
+	content, e := io.ReadAll(r)
+	return content, f.Mode, e
+}
+
+// historyTagsPrefix starts the trailer of the message that holds the tags.
+const historyTagsPrefix = "Tags: "
+
+// historyMessage returns the commit message of a note and tags.
+func historyMessage(note string, tags []string) string {
+	message := note + "\n"
+	if len(tags) > 0 {
+		message += "\n" + historyTagsPrefix + strings.Join(tags, ", ") + "\n"
+	}
+	return message
+}
+
+// parseHistoryMessage returns the note and the tags of a commit message.
+func parseHistoryMessage(message string) (string, []string) {
+	lines := strings.Split(strings.TrimSpace(message), "\n")
+	var tags []string
+	if last, ok := strings.CutPrefix(lines[len(lines)-1], historyTagsPrefix); ok && len(lines) > 1 {
+		tags = strings.Split(last, ", ")
+		lines = lines[:len(lines)-1]
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), tags
+}
+
+// historySignature returns the author of a commit, the user running linate.
+func historySignature() object.Signature {
+	name, e := getCurrentUser()
+	if e != nil {
+		name = "unknown"
+	}
+	host, _ := os.Hostname()
+	return object.Signature{Name: name, Email: name + "@" + host, When: time.Now()}
+}
+
+// shortHash returns the abbreviated hash shown for a revision.
+func shortHash(hash plumbing.Hash) string {
+	return hash.String()[:8]
+}
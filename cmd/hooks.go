@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Hooks are shell commands of the config file that bk runs around its operations.
+// They get the paths of the operation in the environment:
+//
+//	LINATE_HOOK      name of the hook, e.g. pre_take
+//	LINATE_SOURCE    path of the original file or directory
+//	LINATE_BACKUP    path of the backup, empty for pre_take
+//	LINATE_CHECKSUM  sha256 of the content of the backup, when it is known
+//	LINATE_STORE     root of the backup store, empty without one
+//
+// A failing pre hook stops the operation, a failing post hook is only reported.
+const (
+	hookPreTake     = "pre_take"
+	hookPostTake    = "post_take"
+	hookPreDelete   = "pre_delete"
+	hookPostRestore = "post_restore"
+)
+
+// hookEnv is what a hook is told about the operation.
+type hookEnv struct {
+	Source   string
+	Backup   string
+	Checksum string
+	Store    *backupStore
+}
+
+// hookError is returned when a pre hook fails.
+type hookError struct {
+	Hook    string
+	Command string
+	Err     error
+}
+
+func (e *hookError) Error() string {
+	return fmt.Sprintf("the %s hook '%s' failed: %v", e.Hook, e.Command, e.Err)
+}
+
+// exitCode returns the exit status of the hook, 1 when it did not run.
+func (e *hookError) exitCode() int {
+	var exit *exec.ExitError
+	if errors.As(e.Err, &exit) && exit.ExitCode() > 0 {
+		return exit.ExitCode()
+	}
+	return 1
+}
+
+func hookCommands(hook string) []string {
+	hooks := getConfig().Backup.Hooks
+	switch hook {
+	case hookPreTake:
+		return hooks.PreTake
+	case hookPostTake:
+		return hooks.PostTake
+	case hookPreDelete:
+		return hooks.PreDelete
+	case hookPostRestore:
+		return hooks.PostRestore
+	}
+	return nil
+}
+
+// runHooks runs the commands of a hook with sh, in order, and stops at the first
+// one that fails.
+func runHooks(hook string, env hookEnv) error {
+	for _, command := range hookCommands(hook) {
+		c := exec.Command("/bin/sh", "-c", command)
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+		c.Env = append(os.Environ(),
+			"LINATE_HOOK="+hook,
+			"LINATE_SOURCE="+env.Source,
+			"LINATE_BACKUP="+env.Backup,
+			"LINATE_CHECKSUM="+env.Checksum,
+		)
+		if env.Store != nil {
+			c.Env = append(c.Env, "LINATE_STORE="+env.Store.Root)
+		} else {
+			c.Env = append(c.Env, "LINATE_STORE=")
+		}
+		if e := c.Run(); e != nil {
+			return &hookError{Hook: hook, Command: command, Err: e}
+		}
+	}
+	return nil
+}
+
+// runPostHooks runs the commands of a post hook and reports a failure, the
+// operation is done already.
+func runPostHooks(hook string, env hookEnv) {
+	if e := runHooks(hook, env); e != nil {
+		fmt.Printf("%sWarning: %v%s\n", colors["yellow"], e, colors["reset"])
+	}
+}
+
+// exitOnHookError exits with the status of a failed pre hook and tells what was not
+// done. It returns when e is not a hookError.
+func exitOnHookError(e error, aborted string) {
+	var hookErr *hookError
+	if errors.As(e, &hookErr) {
+		fmt.Fprintf(os.Stderr, "%sError: %v. %s%s\n", colors["red"], hookErr, aborted, colors["reset"])
+		os.Exit(hookErr.exitCode())
+	}
+}
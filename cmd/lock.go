@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockPollInterval is how often a waiting linate tries to get a lock again.
+const lockPollInterval = 100 * time.Millisecond
+
+// dirLock is an advisory lock, flock(2), on the directory of a manifest: a backup
+// store or a directory with backups next to the files. createBackup holds it, and
+// so does every change of a manifest, so linate processes working in the same
+// directory, e.g. a cron job and an operator, take turns instead of writing the
+// same manifest at once. The lock goes away with the process.
+type dirLock struct {
+	dir string
+}
+
+// heldLocks are the locks of this process by directory. flock(2) locks an open
+// file, so locking a directory again, e.g. addRecord in createBackup, would wait
+// for itself.
+var (
+	heldLocksMu sync.Mutex
+	heldLocks   = map[string]*heldLock{}
+)
+
+type heldLock struct {
+	f     *os.File
+	count int
+}
+
+// lockedError is returned when another process holds the lock of Dir.
+type lockedError struct {
+	Dir string
+	// Waited is how long linate waited for the lock, zero when it did not wait
+	Waited time.Duration
+}
+
+func (e *lockedError) Error() string {
+	if e.Waited > 0 {
+		return fmt.Sprintf("another linate has been taking a backup in '%s' for longer than %v", e.Dir, e.Waited)
+	}
+	return fmt.Sprintf("another linate is taking a backup in '%s'", e.Dir)
+}
+
+// lockDir locks dir. When it is locked already lockDir waits at most wait for it,
+// forever when wait is negative, or returns a lockedError right away when wait is 0.
+func lockDir(dir string, wait time.Duration) (*dirLock, error) {
+	dir = filepath.Clean(dir)
+	heldLocksMu.Lock()
+	defer heldLocksMu.Unlock()
+	if held, ok := heldLocks[dir]; ok {
+		held.count += 1
+		return &dirLock{dir: dir}, nil
+	}
+
+	f, e := os.Open(dir)
+	if e != nil {
+		return nil, e
+	}
+	start := time.Now()
+	waiting := false
+	for {
+		e = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if e == nil {
+			heldLocks[dir] = &heldLock{f: f, count: 1}
+			return &dirLock{dir: dir}, nil
+		}
+		if errors.Is(e, unix.EWOULDBLOCK) == false {
+			f.Close()
+			return nil, e
+		}
+		if wait == 0 {
+			f.Close()
+			return nil, &lockedError{Dir: dir}
+		}
+		if wait > 0 && time.Since(start) >= wait {
+			f.Close()
+			return nil, &lockedError{Dir: dir, Waited: wait}
+		}
+		if waiting == false {
+			fmt.Printf("%sWaiting for another linate taking a backup in '%s'%s\n", colors["yellow"], dir, colors["reset"])
+			waiting = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// unlock releases the lock.
+func (l *dirLock) unlock() {
+	heldLocksMu.Lock()
+	defer heldLocksMu.Unlock()
+	held, ok := heldLocks[l.dir]
+	if ok == false {
+		return
+	}
+	held.count -= 1
+	if held.count == 0 {
+		unix.Flock(int(held.f.Fd()), unix.LOCK_UN)
+		held.f.Close()
+		delete(heldLocks, l.dir)
+	}
+}
+
+// exitOnLockError exits when e is a lockedError, aborted tells what has not been done.
+func exitOnLockError(e error, aborted string) {
+	var locked *lockedError
+	if errors.As(e, &locked) {
+		hint := ""
+		if locked.Waited == 0 {
+			hint = " Please use the --wait flag to wait for it."
+		}
+		exitWithError(fmt.Sprintf("%sError: %v. %s%s%s\n", colors["red"], locked, aborted, hint, colors["reset"]))
+	}
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyMetadata copies the mode, owner, extended attributes (SELinux labels and POSIX
+// ACLs included) and access/modification times of src to dst. Copying goes on when
+// one of them can not be kept; the returned list describes what was lost.
+func copyMetadata(src string, dst string) []string {
+	var lost []string
+	info, e := os.Lstat(src)
+	if e != nil {
+		return []string{fmt.Sprintf("all metadata (%v)", e)}
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if ok != true {
+		return []string{"all metadata (unexpected file info type)"}
+	}
+
+	// Owner first, changing it clears the setuid and setgid bits
+	e = os.Lchown(dst, int(stat.Uid), int(stat.Gid))
+	if e != nil {
+		lost = append(lost, fmt.Sprintf("owner %d:%d (%v)", stat.Uid, stat.Gid, unwrapPathError(e)))
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		e = os.Chmod(dst, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		if e != nil {
+			lost = append(lost, fmt.Sprintf("mode %v (%v)", info.Mode().Perm(), unwrapPathError(e)))
+		}
+	}
+
+	names, e := listXattrs(src)
+	if e != nil {
+		lost = append(lost, fmt.Sprintf("extended attributes (%v)", e))
+	}
+	for _, name := range names {
+		value, e := getXattr(src, name)
+		if e == nil {
+			e = unix.Lsetxattr(dst, name, value, 0)
+		}
+		if e != nil {
+			lost = append(lost, fmt.Sprintf("%s (%v)", describeXattr(name), e))
+		}
+	}
+
+	// Times last, everything above may update them
+	times := []unix.Timespec{
+		unix.NsecToTimespec(syscall.TimespecToNsec(stat.Atim)),
+		unix.NsecToTimespec(syscall.TimespecToNsec(stat.Mtim)),
+	}
+	e = unix.UtimesNanoAt(unix.AT_FDCWD, dst, times, unix.AT_SYMLINK_NOFOLLOW)
+	if e != nil {
+		lost = append(lost, fmt.Sprintf("access and modification time (%v)", e))
+	}
+	return lost
+}
+
+func listXattrs(path string) ([]string, error) {
+	size, e := unix.Llistxattr(path, nil)
+	if e != nil || size == 0 {
+		if e == unix.ENOTSUP {
+			return nil, nil
+		}
+		return nil, e
+	}
+	buf := make([]byte, size)
+	size, e = unix.Llistxattr(path, buf)
+	if e != nil {
+		return nil, e
+	}
+	var names []string
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func getXattr(path string, name string) ([]byte, error) {
+	size, e := unix.Lgetxattr(path, name, nil)
+	if e != nil {
+		return nil, e
+	}
+	buf := make([]byte, size)
+	size, e = unix.Lgetxattr(path, name, buf)
+	if e != nil {
+		return nil, e
+	}
+	return buf[:size], nil
+}
+
+func describeXattr(name string) string {
+	switch name {
+	case "security.selinux":
+		return "SELinux label"
+	case "system.posix_acl_access", "system.posix_acl_default":
+		return "POSIX ACL"
+	}
+	return "extended attribute " + name
+}
+
+func unwrapPathError(e error) error {
+	if pe, ok := e.(*os.PathError); ok {
+		return pe.Err
+	}
+	return e
+}
+
+// printLostMetadata warns about the metadata copyMetadata could not keep.
+func printLostMetadata(lost []string) {
+	if len(lost) == 0 {
+		return
+	}
+	fmt.Printf("%sThe following metadata could not be kept. Please run as the superuser to keep it.%s\n", colors["yellow"], colors["reset"])
+	for _, l := range lost {
+		fmt.Printf("%s  - %s%s\n", colors["yellow"], l, colors["reset"])
+	}
+}
@@ -0,0 +1,290 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// quotaError is returned when a backup would not fit in the free space of the
+// filesystem, minus the reserve, or in a quota of the config file.
+type quotaError struct {
+	Reason string
+	// Groups are the backups that pruning can delete to make room
+	Groups map[string][]backupFile
+	// MaxTotalSize is the size the backups of Groups have to fit in for the backup
+	// to be taken, zero when pruning can not help
+	MaxTotalSize int64
+}
+
+func (e *quotaError) Error() string {
+	return e.Reason
+}
+
+// backupSizeOf returns the size of the backup of loc before compression, the size of
+// the file or of every file in the directory.
+func backupSizeOf(loc backupLocation, opts backupOptions) (int64, error) {
+	src := loc.Source()
+	if opts.From != "" {
+		src = opts.From
+	}
+	if opts.Recursive == false {
+		info, e := os.Stat(src)
+		if e != nil {
+			return 0, e
+		}
+		return info.Size(), nil
+	}
+	var size int64
+	e := filepath.WalkDir(src, func(path string, d fs.DirEntry, e error) error {
+		if e != nil || d.Type().IsRegular() == false {
+			return nil
+		}
+		if info, e := d.Info(); e == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, e
+}
+
+// parseReserve parses the reserve of the config file, a percentage of the
+// filesystem like 10% or a size like 2G.
+func parseReserve(raw string, total int64) (int64, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	if pct, ok := strings.CutSuffix(raw, "%"); ok {
+		p, e := strconv.ParseFloat(strings.TrimSpace(pct), 64)
+		if e != nil || p < 0 || p > 100 {
+			return 0, fmt.Errorf("invalid percentage '%s'", raw)
+		}
+		return int64(float64(total) * p / 100), nil
+	}
+	return parseSize(raw)
+}
+
+// totalSize returns what the backups of groups take on the disk. The chunks of
+// deduplicated backups are counted once, their reference files are tiny.
+func totalSize(groups map[string][]backupFile) int64 {
+	var all []backupFile
+	for _, backups := range groups {
+		all = append(all, backups...)
+	}
+	_, physical := chunkUsage(all)
+	return physical
+}
+
+// historySize returns what the history repository of loc takes on the disk,
+// pruning can not make it smaller.
+func historySize(loc backupLocation) int64 {
+	dir, _ := loc.historyOf()
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, e error) error {
+		if e != nil || d.Type().IsRegular() == false {
+			return nil
+		}
+		if info, e := d.Info(); e == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// existingDir returns dir or its nearest parent that exists, a store is created by
+// the first backup.
+func existingDir(dir string) string {
+	dir = filepath.Clean(dir)
+	for dirExists(dir) == false && dir != "/" {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+// checkSpace returns a quotaError when the backup of loc would leave less than
+// backup.quota.reserve free on the filesystem, or would exceed the quota of its
+// directory or backup.quota.max_total_size for every backup of the store, or of
+// the directory when the backups are kept next to the files.
+func checkSpace(loc backupLocation, opts backupOptions) error {
+	cfg := getConfig().Backup.Quota
+	size, e := backupSizeOf(loc, opts)
+	if e != nil {
+		return e
+	}
+	allBackups := func() (map[string][]backupFile, error) {
+		if loc.Store != nil {
+			return listBackupGroups("", loc.Store)
+		}
+		return listBackupGroups(loc.Dir, nil)
+	}
+
+	// Free space and inodes of the filesystem of the backup
+	dir := existingDir(loc.BackupDir())
+	var st unix.Statfs_t
+	if e := unix.Statfs(dir, &st); e != nil {
+		return e
+	}
+	free := int64(st.Bavail) * int64(st.Bsize)
+	reserve, e := parseReserve(cfg.Reserve, int64(st.Blocks)*int64(st.Bsize))
+	if e != nil {
+		return fmt.Errorf("invalid backup.quota.reserve in the config file, %v", e)
+	}
+	if free-size < reserve {
+		groups, e := allBackups()
+		if e != nil {
+			return e
+		}
+		reason := fmt.Sprintf("the backup needs %s but only %s are free on the filesystem of '%s'", formatSize(size), formatSize(free), dir)
+		if reserve > 0 {
+			reason += fmt.Sprintf(", %s of it are reserved", formatSize(reserve))
+		}
+		return &quotaError{Reason: reason, Groups: groups, MaxTotalSize: totalSize(groups) - (size + reserve - free)}
+	}
+	// A file takes the name of the backup until its temporary file replaces it,
+	// chunks take one each
+	inodes := uint64(2)
+	if opts.Dedup {
+		inodes += uint64(size/maxChunkSize) + 1
+	}
+	// Some filesystems, e.g. btrfs, have no fixed number of inodes
+	if st.Files > 0 && st.Ffree < inodes {
+		return &quotaError{Reason: fmt.Sprintf("there are no free inodes left on the filesystem of '%s'", dir)}
+	}
+	if opts.SkipQuota {
+		return nil
+	}
+
+	// Quota of the directory of the file
+	for quotaDir, raw := range cfg.Directories {
+		if filepath.Clean(quotaDir) != filepath.Clean(loc.Dir) {
+			continue
+		}
+		limit, e := parseSize(raw)
+		if e != nil {
+			return fmt.Errorf("invalid quota '%s' of '%s' in the config file", raw, quotaDir)
+		}
+		groups, e := listBackupGroups(loc.Dir, loc.Store)
+		if e != nil {
+			return e
+		}
+		// The history of a directory without a store is kept in it
+		var history int64
+		if loc.Store == nil {
+			history = historySize(loc)
+		}
+		if total := totalSize(groups) + history; total+size > limit {
+			return &quotaError{
+				Reason:       fmt.Sprintf("the backups of '%s' would take %s, over its quota of %s", loc.Dir, formatSize(total+size), formatSize(limit)),
+				Groups:       groups,
+				MaxTotalSize: limit - size - history,
+			}
+		}
+	}
+
+	// Quota of every backup
+	if cfg.MaxTotalSize != "" {
+		limit, e := parseSize(cfg.MaxTotalSize)
+		if e != nil {
+			return fmt.Errorf("invalid backup.quota.max_total_size '%s' in the config file", cfg.MaxTotalSize)
+		}
+		groups, e := allBackups()
+		if e != nil {
+			return e
+		}
+		history := historySize(loc)
+		if total := totalSize(groups) + history; total+size > limit {
+			return &quotaError{
+				Reason:       fmt.Sprintf("the backups of '%s' would take %s, over the quota of %s", loc.index().Root, formatSize(total+size), formatSize(limit)),
+				Groups:       groups,
+				MaxTotalSize: limit - size - history,
+			}
+		}
+	}
+	return nil
+}
+
+// pruneForQuota deletes backups of q.Groups according to the retention policy of
+// the config file, and then the oldest ones, until the backup fits. It asks first
+// unless yes is true, and reports whether there is room now.
+func pruneForQuota(q *quotaError, store *backupStore, yes bool) bool {
+	c := getConfig().Backup.Retention
+	policy := retentionPolicy{KeepLast: c.KeepLast, KeepDaily: c.KeepDaily, KeepWeekly: c.KeepWeekly, KeepMonthly: c.KeepMonthly}
+	limit := q.MaxTotalSize
+	if size, e := parseSize(c.MaxTotalSize); e == nil && size < limit {
+		limit = size
+	}
+	var removed []backupFile
+	kept := q.Groups
+	if limit > 0 {
+		removed = policy.forget(q.Groups)
+		kept = withoutBackups(q.Groups, removed)
+		// forget counts the size of the reference files of deduplicated backups, not
+		// of their chunks, so the oldest backups are removed here
+		var oldest []backupFile
+		for _, backups := range kept {
+			oldest = append(oldest, backups...)
+		}
+		sortBackups(oldest)
+		for i := len(oldest) - 1; i >= 0 && totalSize(kept) > limit; i-- {
+			if isNewestOf(oldest[i], q.Groups) {
+				continue
+			}
+			removed = append(removed, oldest[i])
+			kept = withoutBackups(q.Groups, removed)
+		}
+	}
+	freed := totalSize(q.Groups) - totalSize(kept)
+	if len(removed) == 0 || totalSize(kept) > q.MaxTotalSize {
+		fmt.Printf("%sPruning can not make enough room, the newest backup of every file is always kept.%s\n", colors["yellow"], colors["reset"])
+		return false
+	}
+
+	rows := make([]FileInfo, len(removed))
+	for i, b := range removed {
+		rows[i] = newFileInfo(b)
+	}
+	fmt.Printf("%sFollowing %d backup file(s) will be deleted to make room, %s%s\n\n", colors["red"], len(removed), formatSize(freed), colors["reset"])
+	printBackupTable(rows)
+	fmt.Printf("\n")
+	if yes == false {
+		ok := yesNoPrompt("Do you want to delete them and take the backup?", false)
+		if ok == false {
+			return false
+		}
+	}
+	failed := deleteBackups(removed, store)
+	collectChunks(store)
+	return failed == 0
+}
+
+// withoutBackups returns groups without the removed backups.
+func withoutBackups(groups map[string][]backupFile, removed []backupFile) map[string][]backupFile {
+	gone := map[string]bool{}
+	for _, b := range removed {
+		gone[b.Path()] = true
+	}
+	rest := map[string][]backupFile{}
+	for source, backups := range groups {
+		for _, b := range backups {
+			if gone[b.Path()] == false {
+				rest[source] = append(rest[source], b)
+			}
+		}
+	}
+	return rest
+}
+
+// exitOnQuotaError exits when e is a quotaError, aborted tells what has not been done.
+func exitOnQuotaError(e error, aborted string) {
+	var quota *quotaError
+	if errors.As(e, &quota) {
+		exitWithError(fmt.Sprintf("%sError: %v. %s%s\n", colors["red"], quota, aborted, colors["reset"]))
+	}
+}
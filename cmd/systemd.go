@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// systemdUnitDir is where linate installs the systemd units it generates.
+const systemdUnitDir = "/etc/systemd/system"
+
+// linateCommandLine returns the command line that runs linate with args, every
+// argument quoted by quote, systemdQuote for the ExecStart of a unit or shellQuote
+// for a cron job.
+func linateCommandLine(args []string, quote func(string) string) string {
+	exe, e := os.Executable()
+	if e != nil {
+		exe = "linate"
+	}
+	parts := []string{quote(exe)}
+	for _, arg := range args {
+		parts = append(parts, quote(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+// plainArg reports whether arg needs no quoting, neither by systemd nor by sh.
+func plainArg(arg string) bool {
+	if arg == "" {
+		return false
+	}
+	for _, r := range arg {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("-_./:=@,+", r) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// systemdQuote quotes arg for the ExecStart of a unit. systemd expands % as a
+// specifier and $ as a variable everywhere, they are doubled.
+func systemdQuote(arg string) string {
+	arg = strings.ReplaceAll(systemdEscape(arg), "$", "$$")
+	if plainArg(strings.NewReplacer("%", "", "$", "").Replace(arg)) {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`).Replace(arg) + `"`
+}
+
+// systemdEscape escapes the specifiers of systemd in a value of a unit file.
+func systemdEscape(value string) string {
+	return strings.ReplaceAll(value, "%", "%%")
+}
+
+// shellQuote quotes arg for the command of a cron job, run by /bin/sh. Nothing is
+// expanded in single quotes, cron itself ends the command at an unescaped %.
+func shellQuote(arg string) string {
+	if plainArg(arg) == false {
+		arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.ReplaceAll(arg, "%", `\%`)
+}
+
+// installSystemdUnit writes a unit file to systemdUnitDir and returns its path.
+func installSystemdUnit(name string, content string) (string, error) {
+	path := filepath.Join(systemdUnitDir, name)
+	return path, writeFileAtomic(path, []byte(content), 0644)
+}
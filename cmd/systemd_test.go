@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestSystemdQuote(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"/etc/nginx.conf", "/etc/nginx.conf"},
+		{"--every", "--every"},
+		{"/srv/100%", "/srv/100%%"},
+		{"/srv/$HOME", "/srv/$$HOME"},
+		{"/srv/my app", `"/srv/my app"`},
+		{`/srv/a"b\c`, `"/srv/a\"b\\c"`},
+		{"/srv/it's `x`", "\"/srv/it's `x`\""},
+		{"", `""`},
+	}
+	for _, tt := range tests {
+		if got := systemdQuote(tt.arg); got != tt.want {
+			t.Errorf("systemdQuote(%q) = %s, want %s", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	args := []string{"/etc/nginx.conf", "/srv/100%", "/srv/$HOME", "/srv/`id`", "/srv/it's", "/srv/my app", `/srv/a"b\c`, ""}
+	for _, arg := range args {
+		quoted := shellQuote(arg)
+		// cron removes the backslash of \% before running the command
+		command := "printf %s " + strings.ReplaceAll(quoted, `\%`, "%")
+		out, e := exec.Command("/bin/sh", "-c", command).Output()
+		if e != nil {
+			t.Fatalf("sh -c %s: %v", command, e)
+		}
+		if string(out) != arg {
+			t.Errorf("shellQuote(%q) = %s, sh gets %q", arg, quoted, out)
+		}
+		if strings.Contains(strings.ReplaceAll(quoted, `\%`, ""), "%") {
+			t.Errorf("shellQuote(%q) = %s has an unescaped %%", arg, quoted)
+		}
+	}
+}
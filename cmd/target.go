@@ -0,0 +1,420 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// A backup target keeps backups away from the machine, with the layout of a backup
+// store: the backups in the mirrored tree of the original files and manifest.json
+// in the root. Names are slash separated paths relative to the root.
+type backupTarget interface {
+	// Put uploads the local file at path as name
+	Put(name string, path string) error
+	// Get downloads name to the local file at path, fs.ErrNotExist when there is no
+	// such file
+	Get(name string, path string) error
+	// Create uploads the local file at path as name unless name exists, then it
+	// returns fs.ErrExist
+	Create(name string, path string) error
+	Remove(name string) error
+	Exists(name string) (bool, error)
+	String() string
+	Close() error
+}
+
+// S3 credentials and the endpoint of S3-compatible services, e.g. MinIO, are read
+// from the environment like the AWS tools do.
+const (
+	s3EndpointEnv     = "AWS_ENDPOINT_URL"
+	s3RegionEnv       = "AWS_REGION"
+	defaultS3Endpoint = "https://s3.amazonaws.com"
+	sftpPasswordEnv   = "LINATE_SFTP_PASSWORD"
+)
+
+// openTarget opens a target: s3://bucket/prefix, sftp://user@host:port/path or a
+// local directory, also as file:///path.
+func openTarget(raw string) (backupTarget, error) {
+	if strings.Contains(raw, "://") == false {
+		root, e := filepath.Abs(raw)
+		if e != nil {
+			return nil, e
+		}
+		return &localTarget{Root: root}, nil
+	}
+	u, e := url.Parse(raw)
+	if e != nil {
+		return nil, e
+	}
+	switch u.Scheme {
+	case "file":
+		return &localTarget{Root: filepath.Clean(u.Path)}, nil
+	case "s3":
+		return openS3Target(u)
+	case "sftp":
+		return openSFTPTarget(u)
+	}
+	return nil, fmt.Errorf("unknown target '%s'. Available targets are s3://, sftp:// and directories", raw)
+}
+
+// localTarget is a directory, e.g. a mounted NFS share or a USB disk.
+type localTarget struct {
+	Root string
+}
+
+func (t *localTarget) Put(name string, path string) error {
+	dst := filepath.Join(t.Root, filepath.FromSlash(name))
+	if e := os.MkdirAll(filepath.Dir(dst), 0700); e != nil {
+		return e
+	}
+	_, _, e := atomicWrite(dst, "", path, func(tmp string) (string, error) {
+		return copyFile(path, tmp, "", "")
+	})
+	return e
+}
+
+func (t *localTarget) Get(name string, path string) error {
+	_, e := copyFile(filepath.Join(t.Root, filepath.FromSlash(name)), path, "", "")
+	return e
+}
+
+func (t *localTarget) Create(name string, path string) error {
+	dst := filepath.Join(t.Root, filepath.FromSlash(name))
+	if e := os.MkdirAll(filepath.Dir(dst), 0700); e != nil {
+		return e
+	}
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return e
+	}
+	f, e := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if e != nil {
+		return e
+	}
+	if _, e = f.Write(data); e != nil {
+		f.Close()
+		os.Remove(dst)
+		return e
+	}
+	return f.Close()
+}
+
+func (t *localTarget) Remove(name string) error {
+	return os.Remove(filepath.Join(t.Root, filepath.FromSlash(name)))
+}
+
+func (t *localTarget) Exists(name string) (bool, error) {
+	_, e := os.Stat(filepath.Join(t.Root, filepath.FromSlash(name)))
+	if errors.Is(e, fs.ErrNotExist) {
+		return false, nil
+	}
+	return e == nil, e
+}
+
+func (t *localTarget) String() string {
+	return t.Root
+}
+
+func (t *localTarget) Close() error {
+	return nil
+}
+
+// s3Target is a bucket of S3 or of an S3-compatible service.
+type s3Target struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func openS3Target(u *url.URL) (*s3Target, error) {
+	raw := os.Getenv(s3EndpointEnv)
+	if raw == "" {
+		raw = defaultS3Endpoint
+	}
+	endpoint, e := url.Parse(raw)
+	if e != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid %s '%s'", s3EndpointEnv, raw)
+	}
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{},
+	})
+	client, e := minio.New(endpoint.Host, &minio.Options{
+		Creds:  creds,
+		Secure: endpoint.Scheme != "http",
+		Region: os.Getenv(s3RegionEnv),
+	})
+	if e != nil {
+		return nil, e
+	}
+	if u.Host == "" {
+		return nil, errors.New("the s3 target has no bucket, e.g. s3://bucket/prefix")
+	}
+	return &s3Target{client: client, bucket: u.Host, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+func (t *s3Target) key(name string) string {
+	return path.Join(t.prefix, name)
+}
+
+func (t *s3Target) Put(name string, local string) error {
+	_, e := t.client.FPutObject(context.Background(), t.bucket, t.key(name), local, minio.PutObjectOptions{})
+	return e
+}
+
+func (t *s3Target) Get(name string, local string) error {
+	e := t.client.FGetObject(context.Background(), t.bucket, t.key(name), local, minio.GetObjectOptions{})
+	if minio.ToErrorResponse(e).Code == "NoSuchKey" {
+		return fs.ErrNotExist
+	}
+	return e
+}
+
+// Create is a conditional put, If-None-Match: *.
+func (t *s3Target) Create(name string, local string) error {
+	opts := minio.PutObjectOptions{}
+	opts.SetMatchETagExcept("*")
+	_, e := t.client.FPutObject(context.Background(), t.bucket, t.key(name), local, opts)
+	if minio.ToErrorResponse(e).Code == "PreconditionFailed" {
+		return fs.ErrExist
+	}
+	return e
+}
+
+func (t *s3Target) Remove(name string) error {
+	return t.client.RemoveObject(context.Background(), t.bucket, t.key(name), minio.RemoveObjectOptions{})
+}
+
+func (t *s3Target) Exists(name string) (bool, error) {
+	_, e := t.client.StatObject(context.Background(), t.bucket, t.key(name), minio.StatObjectOptions{})
+	if minio.ToErrorResponse(e).Code == "NoSuchKey" {
+		return false, nil
+	}
+	return e == nil, e
+}
+
+func (t *s3Target) String() string {
+	return "s3://" + path.Join(t.bucket, t.prefix)
+}
+
+func (t *s3Target) Close() error {
+	return nil
+}
+
+// sftpTarget is a directory on an SSH server.
+type sftpTarget struct {
+	conn   *ssh.Client
+	client *sftp.Client
+	host   string
+	root   string
+}
+
+// sshAuthMethods returns the ssh agent, the default keys of the user and the
+// password of the environment, whichever there are.
+func sshAuthMethods() []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, e := net.Dial("unix", sock); e == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	home, _ := os.UserHomeDir()
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		data, e := os.ReadFile(filepath.Join(home, ".ssh", name))
+		if e != nil {
+			continue
+		}
+		if signer, e := ssh.ParsePrivateKey(data); e == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if password := os.Getenv(sftpPasswordEnv); password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+	return methods
+}
+
+func openSFTPTarget(u *url.URL) (*sftpTarget, error) {
+	username := u.User.Username()
+	if username == "" {
+		current, e := user.Current()
+		if e != nil {
+			return nil, e
+		}
+		username = current.Username
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+	home, _ := os.UserHomeDir()
+	knownHosts := filepath.Join(home, ".ssh", "known_hosts")
+	hostKeys, e := knownhosts.New(knownHosts)
+	if e != nil {
+		return nil, fmt.Errorf("can not read '%s' to check the key of the server, add the server with ssh-keyscan: %v", knownHosts, e)
+	}
+	conn, e := ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            username,
+		Auth:            sshAuthMethods(),
+		HostKeyCallback: hostKeys,
+	})
+	if e != nil {
+		return nil, e
+	}
+	client, e := sftp.NewClient(conn)
+	if e != nil {
+		conn.Close()
+		return nil, e
+	}
+	root := u.Path
+	if root == "" {
+		root = "."
+	}
+	return &sftpTarget{conn: conn, client: client, host: u.Host, root: root}, nil
+}
+
+func (t *sftpTarget) remotePath(name string) string {
+	return path.Join(t.root, name)
+}
+
+// Put writes to a temporary file and renames it, so a broken connection never
+// leaves a partial backup behind.
+func (t *sftpTarget) Put(name string, local string) error {
+	src, e := os.Open(local)
+	if e != nil {
+		return e
+	}
+	defer src.Close()
+	dst := t.remotePath(name)
+	if e = t.client.MkdirAll(path.Dir(dst)); e != nil {
+		return e
+	}
+	// Every upload has its own temporary file, another linate may upload the same name
+	tmp := path.Join(path.Dir(dst), fmt.Sprintf(".%s.linate-tmp-%d-%d", path.Base(dst), os.Getpid(), time.Now().UnixNano()))
+	f, e := t.client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if e != nil {
+		return e
+	}
+	if _, e = io.Copy(f, src); e != nil {
+		f.Close()
+		t.client.Remove(tmp)
+		return e
+	}
+	if e = f.Close(); e != nil {
+		t.client.Remove(tmp)
+		return e
+	}
+	return replaceRemote(t.client, tmp, dst)
+}
+
+// remoteRenamer renames and removes the files of a target, *sftp.Client.
+type remoteRenamer interface {
+	PosixRename(oldname, newname string) error
+	Rename(oldname, newname string) error
+	Remove(path string) error
+}
+
+// replaceRemote renames tmp to dst. Servers without the posix-rename extension can
+// not rename over a file, dst is moved aside first and put back when tmp can not
+// replace it. tmp is removed when it fails.
+func replaceRemote(c remoteRenamer, tmp string, dst string) error {
+	if c.PosixRename(tmp, dst) == nil {
+		return nil
+	}
+	old := tmp + ".old"
+	e := c.Rename(dst, old)
+	if e != nil && errors.Is(e, fs.ErrNotExist) == false {
+		c.Remove(tmp)
+		return e
+	}
+	moved := e == nil
+	if e = c.Rename(tmp, dst); e != nil {
+		if moved {
+			c.Rename(old, dst)
+		}
+		c.Remove(tmp)
+		return e
+	}
+	if moved {
+		c.Remove(old)
+	}
+	return nil
+}
+
+func (t *sftpTarget) Get(name string, local string) error {
+	src, e := t.client.Open(t.remotePath(name))
+	if e != nil {
+		return e
+	}
+	defer src.Close()
+	_, e = copyReader(src, local, "", -1)
+	return e
+}
+
+func (t *sftpTarget) Create(name string, local string) error {
+	data, e := os.ReadFile(local)
+	if e != nil {
+		return e
+	}
+	dst := t.remotePath(name)
+	if e = t.client.MkdirAll(path.Dir(dst)); e != nil {
+		return e
+	}
+	f, e := t.client.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if e != nil {
+		// Servers do not all tell why the file can not be created
+		if exists, _ := t.Exists(name); exists {
+			return fs.ErrExist
+		}
+		return e
+	}
+	if _, e = f.Write(data); e != nil {
+		f.Close()
+		t.client.Remove(dst)
+		return e
+	}
+	return f.Close()
+}
+
+func (t *sftpTarget) Remove(name string) error {
+	return t.client.Remove(t.remotePath(name))
+}
+
+func (t *sftpTarget) Exists(name string) (bool, error) {
+	_, e := t.client.Stat(t.remotePath(name))
+	if errors.Is(e, fs.ErrNotExist) {
+		return false, nil
+	}
+	return e == nil, e
+}
+
+func (t *sftpTarget) String() string {
+	return "sftp://" + t.host + "/" + strings.TrimPrefix(t.root, "/")
+}
+
+func (t *sftpTarget) Close() error {
+	t.client.Close()
+	return t.conn.Close()
+}
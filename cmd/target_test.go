@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+// fakeRemote is a server without the posix-rename extension, renaming over a file
+// fails like on SFTP version 3.
+type fakeRemote struct {
+	files map[string]string
+	// failFrom makes renames of this file fail
+	failFrom string
+}
+
+func (r *fakeRemote) PosixRename(oldname, newname string) error {
+	return errors.New("posix-rename@openssh.com is not supported")
+}
+
+func (r *fakeRemote) Rename(oldname, newname string) error {
+	content, ok := r.files[oldname]
+	if ok == false {
+		return fs.ErrNotExist
+	}
+	if _, exists := r.files[newname]; exists || oldname == r.failFrom {
+		return errors.New("failure")
+	}
+	r.files[newname] = content
+	delete(r.files, oldname)
+	return nil
+}
+
+func (r *fakeRemote) Remove(path string) error {
+	if _, ok := r.files[path]; ok == false {
+		return fs.ErrNotExist
+	}
+	delete(r.files, path)
+	return nil
+}
+
+func TestReplaceRemote(t *testing.T) {
+	r := &fakeRemote{files: map[string]string{"tmp": "new", "manifest.json": "old"}}
+	if e := replaceRemote(r, "tmp", "manifest.json"); e != nil {
+		t.Fatal(e)
+	}
+	if len(r.files) != 1 || r.files["manifest.json"] != "new" {
+		t.Errorf("the files are %v, want the new manifest.json", r.files)
+	}
+
+	r = &fakeRemote{files: map[string]string{"tmp": "new"}}
+	if e := replaceRemote(r, "tmp", "backup"); e != nil {
+		t.Fatal(e)
+	}
+	if len(r.files) != 1 || r.files["backup"] != "new" {
+		t.Errorf("the files are %v, want the new backup", r.files)
+	}
+}
+
+func TestReplaceRemoteFails(t *testing.T) {
+	r := &fakeRemote{files: map[string]string{"tmp": "new", "manifest.json": "old"}, failFrom: "tmp"}
+	if e := replaceRemote(r, "tmp", "manifest.json"); e == nil {
+		t.Fatal("replacing succeeded although the rename failed")
+	}
+	if len(r.files) != 1 || r.files["manifest.json"] != "old" {
+		t.Errorf("the files are %v, want the old manifest.json", r.files)
+	}
+}